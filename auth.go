@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/amenzhinsky/vsftpdmgr/mgr"
+)
+
+// identity is an authenticated API caller.
+type identity struct {
+	// method is either "token" or "cert".
+	method string
+
+	// name is the token label or the client certificate common name,
+	// the first SAN is used when the certificate has no common name.
+	name string
+
+	role mgr.Role
+
+	// tenant confines the caller to users of the tenant when set.
+	tenant string
+}
+
+func (id *identity) String() string {
+	if id.tenant != "" {
+		return id.method + ":" + id.tenant + "/" + id.name
+	}
+	return id.method + ":" + id.name
+}
+
+type identityKey struct{}
+
+// identityFromContext returns the caller identity
+// or nil when the request is not authenticated.
+func identityFromContext(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// withIdentity attaches the identity to the request and scopes it
+// to the identity's tenant, it's also reported in the request log line
+// and recorded in the audit log as the actor of all mutations.
+func withIdentity(w http.ResponseWriter, r *http.Request, id *identity) *http.Request {
+	if rw, ok := w.(*responseWriter); ok {
+		rw.caller = id.String()
+	}
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	ctx := context.WithValue(r.Context(), identityKey{}, id)
+	ctx = mgr.WithActor(ctx, mgr.Actor{Name: id.String(), Addr: addr})
+	if id.tenant != "" {
+		ctx = mgr.WithTenant(ctx, id.tenant)
+	}
+	return r.WithContext(ctx)
+}
+
+var (
+	errUnauthorized = &requestError{http.StatusUnauthorized, "unauthorized", "missing or invalid bearer token"}
+	errCertDenied   = &requestError{http.StatusForbidden, "forbidden", "client certificate is not allowed"}
+	errForbidden    = &requestError{http.StatusForbidden, "forbidden", "operation is not permitted"}
+)
+
+// authenticated lets through only requests made with a verified client
+// certificate that passes the allowlists or carrying a valid bearer token.
+func authenticated(m *mgr.Mgr, c *config, f handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			if !c.allowCert(cert) {
+				return errCertDenied
+			}
+			name := certName(cert)
+			role, ok := c.clientRoles[name]
+			if !ok {
+				role = c.clientDefaultRole
+			}
+			return f(w, withIdentity(w, r, &identity{
+				method: "cert",
+				name:   name,
+				role:   role,
+				tenant: c.clientTenants[name],
+			}))
+		}
+
+		secret := bearerToken(r)
+		if secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vsftpdmgr"`)
+			return errUnauthorized
+		}
+
+		t, err := m.Authenticate(r.Context(), secret)
+		if err == mgr.ErrTokenNotFound {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vsftpdmgr", error="invalid_token"`)
+			return errUnauthorized
+		} else if err != nil {
+			return err
+		}
+		return f(w, withIdentity(w, r, &identity{
+			method: "token",
+			name:   t.Label,
+			role:   t.Role,
+			tenant: t.Tenant,
+		}))
+	}
+}
+
+// anonymous grants everything to all requests, used when authentication is disabled.
+func anonymous(f handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		return f(w, withIdentity(w, r, &identity{method: "none", name: "anonymous", role: mgr.RoleAdmin}))
+	}
+}
+
+// authorize checks that the caller is granted all the permissions.
+func authorize(r *http.Request, perms ...mgr.Permission) error {
+	id := identityFromContext(r.Context())
+	if id == nil {
+		return errUnauthorized
+	}
+	for _, perm := range perms {
+		if !id.role.Can(perm) {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// bearerToken extracts the token from the Authorization header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// allowCert checks the certificate against the CN and SAN allowlists,
+// any certificate signed by the CA is allowed when both are empty.
+func (c *config) allowCert(cert *x509.Certificate) bool {
+	if len(c.clientCNs) == 0 && len(c.clientSANs) == 0 {
+		return true
+	}
+	for _, cn := range c.clientCNs {
+		if cert.Subject.CommonName == cn {
+			return true
+		}
+	}
+	for _, san := range certSANs(cert) {
+		for _, allowed := range c.clientSANs {
+			if san == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if sans := certSANs(cert); len(sans) != 0 {
+		return sans[0]
+	}
+	return cert.SerialNumber.String()
+}
+
+// certSANs returns all subject alternative names of the certificate.
+func certSANs(cert *x509.Certificate) []string {
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.EmailAddresses)+
+		len(cert.IPAddresses)+len(cert.URIs))
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
@@ -0,0 +1,59 @@
+// Package testenv prepares the environment managers are tested in, it's
+// shared by tests of the mgr package and of the server, so their setups
+// cannot drift apart, and doesn't import mgr to be usable by its tests.
+package testenv
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Mgr is what Cleanup needs of a manager, *mgr.Mgr implements it.
+type Mgr interface {
+	Clean() error
+	Close() error
+}
+
+// New returns the database url from TEST_DATABASE_URL along with temporary
+// root and pwdfile that are removed when the test finishes.
+func New(t testing.TB) (databaseURL, root, pwdfile string) {
+	t.Helper()
+	databaseURL = os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Fatal("TEST_DATABASE_URL is empty")
+	}
+
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Remove(f.Name())
+	})
+	return databaseURL, root, f.Name()
+}
+
+// Cleanup removes all data of the manager from the database
+// and closes it when the test finishes.
+func Cleanup(t testing.TB, m Mgr) {
+	t.Cleanup(func() {
+		if err := m.Clean(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
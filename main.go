@@ -2,18 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/amenzhinsky/vsftpdmgr/mgr"
@@ -23,7 +31,39 @@ var (
 	addrFlag     = ":8080"
 	certFileFlag = ""
 	keyFileFlag  = ""
+	caFileFlag   = ""
 	syncFlag     = false
+	checkFlag    = false
+
+	reconcileIntervalFlag time.Duration
+	lockTimeoutFlag       = 30 * time.Second
+
+	clientCNFlag          = ""
+	clientSANFlag         = ""
+	clientRolesFlag       = ""
+	clientDefaultRoleFlag = string(mgr.RoleReadOnly)
+	clientTenantsFlag     = ""
+
+	archiveDirFlag = ""
+	restoreFlag    = ""
+
+	userConfigDirFlag = ""
+
+	noAuthFlag      = false
+	createTokenFlag = ""
+	roleFlag        = string(mgr.RoleReadOnly)
+	revokeTokenFlag = ""
+	listTokensFlag  = false
+	tenantFlag      = ""
+
+	createTenantFlag = ""
+	deleteTenantFlag = ""
+	listTenantsFlag  = false
+
+	addWebhookFlag    = ""
+	eventsFlag        = ""
+	removeWebhookFlag = ""
+	listWebhooksFlag  = false
 )
 
 func main() {
@@ -39,7 +79,32 @@ Options:
 	flag.StringVar(&addrFlag, "addr", addrFlag, "`address` to listen to")
 	flag.StringVar(&certFileFlag, "cert-file", certFileFlag, "`path` to TLS certificate file")
 	flag.StringVar(&keyFileFlag, "key-file", keyFileFlag, "`path` to TLS key file")
+	flag.StringVar(&caFileFlag, "ca-file", caFileFlag, "`path` to CA bundle to verify client certificates with")
+	flag.StringVar(&clientCNFlag, "client-cn", clientCNFlag, "comma-separated `list` of allowed client certificate common names")
+	flag.StringVar(&clientSANFlag, "client-san", clientSANFlag, "comma-separated `list` of allowed client certificate subject alternative names")
+	flag.StringVar(&clientRolesFlag, "client-roles", clientRolesFlag, "comma-separated `list` of name=role pairs granting roles to client certificates")
+	flag.StringVar(&clientDefaultRoleFlag, "client-default-role", clientDefaultRoleFlag, "`role` granted to client certificates missing in -client-roles")
+	flag.StringVar(&clientTenantsFlag, "client-tenants", clientTenantsFlag, "comma-separated `list` of name=tenant pairs confining client certificates to tenants")
 	flag.BoolVar(&syncFlag, "sync", syncFlag, "sync pwdfile with database and exit immediately")
+	flag.BoolVar(&checkFlag, "check", checkFlag, "compare database to pwdfile and root, print differences and exit immediately, non-zero exit status means drift")
+	flag.DurationVar(&reconcileIntervalFlag, "reconcile-interval", reconcileIntervalFlag, "rewrite out of sync pwdfile and recreate missing local roots every `interval`, disabled when zero")
+	flag.DurationVar(&lockTimeoutFlag, "lock-timeout", lockTimeoutFlag, "maximum `duration` operations wait for each other across all instances")
+	flag.StringVar(&archiveDirFlag, "archive-dir", archiveDirFlag, "archive deleted users' local roots to `path`")
+	flag.StringVar(&userConfigDirFlag, "user-config-dir", userConfigDirFlag, "write users' settings to vsftpd user_config_dir `path`")
+	flag.StringVar(&restoreFlag, "restore", restoreFlag, "restore deleted `username` from archive and exit immediately")
+	flag.BoolVar(&noAuthFlag, "insecure-no-auth", noAuthFlag, "disable API authentication, anyone reaching the address can manage users")
+	flag.StringVar(&createTokenFlag, "create-token", createTokenFlag, "create API token with the given `label`, print it and exit immediately")
+	flag.StringVar(&roleFlag, "role", roleFlag, "`role` granted to the token created with -create-token: read-only, operator or admin")
+	flag.StringVar(&revokeTokenFlag, "revoke-token", revokeTokenFlag, "revoke API token with the given `label` and exit immediately")
+	flag.StringVar(&tenantFlag, "tenant", tenantFlag, "confine the token created with -create-token to users of the `tenant`")
+	flag.BoolVar(&listTokensFlag, "list-tokens", listTokensFlag, "list API tokens and exit immediately")
+	flag.StringVar(&createTenantFlag, "create-tenant", createTenantFlag, "create tenant with the given `name` and exit immediately")
+	flag.StringVar(&deleteTenantFlag, "delete-tenant", deleteTenantFlag, "delete empty tenant with the given `name` and exit immediately")
+	flag.BoolVar(&listTenantsFlag, "list-tenants", listTenantsFlag, "list tenants and exit immediately")
+	flag.StringVar(&addWebhookFlag, "add-webhook", addWebhookFlag, "add webhook receiving user events at `url`, print its signing secret and exit immediately")
+	flag.StringVar(&eventsFlag, "events", eventsFlag, "comma-separated `list` of events sent to the webhook added with -add-webhook, all by default")
+	flag.StringVar(&removeWebhookFlag, "remove-webhook", removeWebhookFlag, "remove webhook with the given `url` and exit immediately")
+	flag.BoolVar(&listWebhooksFlag, "list-webhooks", listWebhooksFlag, "list webhooks and exit immediately")
 	flag.Parse()
 	if flag.NArg() != 2 {
 		flag.Usage()
@@ -57,7 +122,15 @@ func run(root, pwdfile string) error {
 		return errors.New("DATABASE_URL not provided")
 	}
 
-	m, err := mgr.New(root, pwdfile, databaseURL)
+	opts := []mgr.Option{mgr.WithLockTimeout(lockTimeoutFlag)}
+	if archiveDirFlag != "" {
+		opts = append(opts, mgr.WithArchiveDir(archiveDirFlag))
+	}
+	if userConfigDirFlag != "" {
+		opts = append(opts, mgr.WithUserConfigDir(userConfigDirFlag))
+	}
+
+	m, err := mgr.New(root, pwdfile, databaseURL, opts...)
 	if err != nil {
 		return err
 	}
@@ -66,6 +139,97 @@ func run(root, pwdfile string) error {
 	if syncFlag {
 		return m.Sync(context.Background())
 	}
+	if checkFlag {
+		d, err := m.Diff(context.Background())
+		if err != nil {
+			return err
+		}
+		printDiff(os.Stdout, d)
+		if !d.Empty() {
+			return errDrift
+		}
+		return nil
+	}
+	if restoreFlag != "" {
+		return m.Restore(mgr.WithActor(context.Background(), mgr.Actor{Name: "cli"}), restoreFlag)
+	}
+	if createTokenFlag != "" {
+		role, err := mgr.ParseRole(roleFlag)
+		if err != nil {
+			return err
+		}
+		secret, _, err := m.CreateToken(context.Background(), createTokenFlag, role, tenantFlag)
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	}
+	if revokeTokenFlag != "" {
+		return m.RevokeToken(context.Background(), revokeTokenFlag)
+	}
+	if listTokensFlag {
+		tokens, err := m.ListTokens(context.Background())
+		if err != nil {
+			return err
+		}
+		return printTokens(os.Stdout, tokens)
+	}
+	if createTenantFlag != "" {
+		_, err := m.CreateTenant(context.Background(), createTenantFlag)
+		return err
+	}
+	if deleteTenantFlag != "" {
+		return m.DeleteTenant(context.Background(), deleteTenantFlag)
+	}
+	if listTenantsFlag {
+		tenants, err := m.ListTenants(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, t := range tenants {
+			fmt.Println(t.Name)
+		}
+		return nil
+	}
+	if addWebhookFlag != "" {
+		secret, _, err := m.AddWebhook(context.Background(), addWebhookFlag, splitList(eventsFlag))
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	}
+	if removeWebhookFlag != "" {
+		return m.RemoveWebhook(context.Background(), removeWebhookFlag)
+	}
+	if listWebhooksFlag {
+		webhooks, err := m.ListWebhooks(context.Background())
+		if err != nil {
+			return err
+		}
+		return printWebhooks(os.Stdout, webhooks)
+	}
+
+	tlsConfig, err := clientTLSConfig(caFileFlag)
+	if err != nil {
+		return err
+	}
+	clientRoles, err := parseRoles(clientRolesFlag)
+	if err != nil {
+		return err
+	}
+	clientTenants, err := parsePairs(clientTenantsFlag)
+	if err != nil {
+		return err
+	}
+	clientDefaultRole, err := mgr.ParseRole(clientDefaultRoleFlag)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && (certFileFlag == "" || keyFileFlag == "") {
+		return errors.New("-ca-file requires -cert-file and -key-file")
+	}
 
 	lis, err := net.Listen("tcp", addrFlag)
 	if err != nil {
@@ -74,13 +238,40 @@ func run(root, pwdfile string) error {
 	defer lis.Close()
 	log.Printf("listening to %s", addrFlag)
 
-	srv := &http.Server{Handler: handler(m)}
+	srv := &http.Server{
+		Handler: handler(m, &config{
+			noAuth:            noAuthFlag,
+			clientCNs:         splitList(clientCNFlag),
+			clientSANs:        splitList(clientSANFlag),
+			clientRoles:       clientRoles,
+			clientDefaultRole: clientDefaultRole,
+			clientTenants:     clientTenants,
+		}),
+		TLSConfig: tlsConfig,
+	}
+
+	// webhook events are delivered in background, so slow or unavailable
+	// receivers never delay API requests, changes made by other instances
+	// sharing the database are applied in background too.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.DeliverWebhooks(ctx)
+	go func() {
+		if err := m.Listen(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("listen error: %s", err)
+		}
+	}()
+	if reconcileIntervalFlag > 0 {
+		go reconcile(ctx, m, reconcileIntervalFlag)
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sig
 		signal.Reset()
 		log.Print("shutting down...")
+		cancel()
 		if err := srv.Shutdown(context.Background()); err != nil {
 			log.Printf("shutdown error: %s", err)
 		}
@@ -100,96 +291,859 @@ func run(root, pwdfile string) error {
 	return nil
 }
 
-func handler(m *mgr.Mgr) http.Handler {
+// reconcile heals drift every interval until ctx is done logging every correction.
+func reconcile(ctx context.Context, m *mgr.Mgr, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		corrections, err := m.Reconcile(ctx)
+		for _, c := range corrections {
+			log.Printf("reconcile: %s", c)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("reconcile error: %s", err)
+		}
+	}
+}
+
+// clientTLSConfig makes the server verify client certificates against the CA
+// bundle, certificates are optional since clients may use tokens instead.
+func clientTLSConfig(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s doesn't contain any PEM certificates", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
+
+// splitList splits comma-separated flag values.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// parseRoles parses comma-separated name=role pairs.
+func parseRoles(s string) (map[string]mgr.Role, error) {
+	pairs, err := parsePairs(s)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]mgr.Role, len(pairs))
+	for name, v := range pairs {
+		role, err := mgr.ParseRole(v)
+		if err != nil {
+			return nil, err
+		}
+		roles[name] = role
+	}
+	return roles, nil
+}
+
+// parsePairs parses comma-separated name=value pairs.
+func parsePairs(s string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, v := range splitList(s) {
+		i := strings.IndexByte(v, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("%q is not a name=value pair", v)
+		}
+		pairs[v[:i]] = v[i+1:]
+	}
+	return pairs, nil
+}
+
+// printTokens writes tokens as a table, secrets are not printed since
+// they're not stored, the table is meant to find out what to revoke.
+func printTokens(w io.Writer, tokens []*mgr.Token) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tROLE\tTENANT\tCREATED\tLAST USED")
+	for _, t := range tokens {
+		lastUsed := "never"
+		if t.LastUsedAt != nil {
+			lastUsed = t.LastUsedAt.Format(time.RFC3339)
+		}
+		tenant := t.Tenant
+		if tenant == "" {
+			tenant = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.Label, t.Role, tenant, t.CreatedAt.Format(time.RFC3339), lastUsed)
+	}
+	return tw.Flush()
+}
+
+// errDrift makes -check exit with non-zero status.
+var errDrift = errors.New("drift detected, run with -sync to rewrite the pwdfile")
+
+// printDiff writes the diff one problem per line, so it can be grepped.
+func printDiff(w io.Writer, d *mgr.Diff) {
+	for _, v := range d.MissingUsers {
+		fmt.Fprintf(w, "missing in pwdfile: %s\n", v)
+	}
+	for _, v := range d.ExtraUsers {
+		fmt.Fprintf(w, "extra in pwdfile: %s\n", v)
+	}
+	for _, v := range d.PasswordMismatches {
+		fmt.Fprintf(w, "password mismatch: %s\n", v)
+	}
+	for _, v := range d.MalformedLines {
+		fmt.Fprintf(w, "malformed pwdfile line: %d\n", v)
+	}
+	for _, v := range d.DuplicateLines {
+		fmt.Fprintf(w, "duplicate pwdfile login: line %d\n", v)
+	}
+	for _, v := range d.OrphanHomes {
+		fmt.Fprintf(w, "orphan home: %s\n", v)
+	}
+	for _, v := range d.MissingHomes {
+		fmt.Fprintf(w, "missing home: %s\n", v)
+	}
+	if d.Empty() {
+		fmt.Fprintln(w, "no drift detected")
+	}
+}
+
+// printWebhooks writes webhooks as a table along with their delivery queues.
+func printWebhooks(w io.Writer, webhooks []*mgr.Webhook) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tEVENTS\tPENDING\tFAILED\tCREATED")
+	for _, wh := range webhooks {
+		events := "all"
+		if len(wh.Events) != 0 {
+			events = strings.Join(wh.Events, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", wh.URL, events, wh.Pending, wh.Failed,
+			wh.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+// config is the HTTP API configuration.
+type config struct {
+	// noAuth disables authentication of API requests.
+	noAuth bool
+
+	// clientCNs and clientSANs restrict client certificates
+	// that are allowed to access the API.
+	clientCNs  []string
+	clientSANs []string
+
+	// clientRoles maps client certificate names to roles,
+	// clientDefaultRole is granted to the rest of certificates.
+	clientRoles       map[string]mgr.Role
+	clientDefaultRole mgr.Role
+
+	// clientTenants confines client certificates to tenants by names.
+	clientTenants map[string]string
+}
+
+func handler(m *mgr.Mgr, c *config) http.Handler {
+	auth := func(f handlerFunc) handlerFunc {
+		if c.noAuth {
+			return anonymous(f)
+		}
+		return authenticated(m, c, f)
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/health", handlerFunc(healthHandler))
-	mux.Handle("/users", usersHandler(m))
-	mux.Handle("/users/", usersHandler(m))
+	mux.Handle("/health", route("/health", healthHandler))
+	mux.Handle("/ready", route("/ready", readyHandler(m)))
+	mux.Handle("/metrics", route("/metrics", auth(metricsHandler(m))))
+	mux.Handle("/users", route("/users", auth(usersHandler(m))))
+	mux.Handle("/users/", route("/users/{username}", auth(userHandler(m))))
+	mux.Handle("/templates", route("/templates", auth(templatesHandler(m))))
+	mux.Handle("/templates/", route("/templates/{name}", auth(templateHandler(m))))
+	mux.Handle("/audit", route("/audit", auth(auditHandler(m))))
 	mux.Handle("/", handlerFunc(func(w http.ResponseWriter, r *http.Request) error {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return nil
+		return errNotFound
 	}))
 	return mux
 }
 
+// route labels requests served by f in metrics with the path template.
+func route(template string, f handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		setRoute(w, template)
+		return f(w, r)
+	}
+}
+
+func setRoute(w http.ResponseWriter, template string) {
+	if rw, ok := w.(*responseWriter); ok {
+		rw.route = template
+	}
+}
+
 // GET /health
 func healthHandler(w http.ResponseWriter, _ *http.Request) error {
 	_, err := w.Write([]byte("ok\n"))
 	return err
 }
 
+// GET /ready
+func readyHandler(m *mgr.Mgr) handlerFunc {
+	var c readyCache
+	return func(w http.ResponseWriter, r *http.Request) error {
+		checks, ok := c.get(r.Context(), m)
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusServiceUnavailable
+		}
+		return writeJSON(w, code, &readyResponse{Ready: ok, Checks: checks})
+	}
+}
+
+// readyCache shares results of readiness checks between probes for
+// readyCacheTTL, so unauthenticated callers cannot load the database.
+type readyCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	checks  []*mgr.Check
+	ok      bool
+}
+
+// readyCacheTTL is how long results of readiness checks are reused.
+const readyCacheTTL = time.Second
+
+func (c *readyCache) get(ctx context.Context, m *mgr.Mgr) ([]*mgr.Check, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < readyCacheTTL {
+		return c.checks, c.ok
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	c.checks, c.ok = m.Ready(ctx)
+	c.checked = time.Now()
+
+	// failures are logged but not disclosed to anonymous callers.
+	for _, check := range c.checks {
+		if check.Err != nil {
+			log.Printf("ready check %s failed: %s", check.Name, check.Err)
+		}
+	}
+	return c.checks, c.ok
+}
+
+// readyTimeout limits readiness checks, so probes
+// get the response before they give up themselves.
+const readyTimeout = 5 * time.Second
+
+type readyResponse struct {
+	Ready  bool         `json:"ready"`
+	Checks []*mgr.Check `json:"checks"`
+}
+
 // GET    /users
 // POST   /users {"username": "...", "password": "..."}
-// DELETE /users {"username": "..."}
+// DELETE /users {"username": "..."} (deprecated, use DELETE /users/{username})
 func usersHandler(m *mgr.Mgr) handlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		switch r.Method {
 		case http.MethodGet:
+			if err := authorize(r, mgr.PermReadUsers); err != nil {
+				return err
+			}
 			users, err := m.List(r.Context())
 			if err != nil {
 				return err
 			}
-			b, err := json.Marshal(users)
+			return writeJSON(w, http.StatusOK, users)
+		case http.MethodPost:
+			var u mgr.User
+			fields, err := bindUser(r, &u)
 			if err != nil {
 				return err
 			}
-
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			_, err = w.Write(b)
-			return err
-		case http.MethodPost:
+			return saveUser(w, r, m, &u, fields)
+		case http.MethodDelete:
 			var u mgr.User
 			if err := bind(r, &u); err != nil {
 				return err
 			}
-			if err := m.Save(r.Context(), &u); err != nil {
-				if err == mgr.ErrInvalidUser {
-					http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-					return nil
-				}
+			deprecated(w, "/users/"+u.Username)
+			if err := authorize(r, mgr.PermDeleteUsers); err != nil {
+				return err
+			}
+			if err := m.Delete(r.Context(), &u); err != nil {
 				return err
 			}
 			w.WriteHeader(http.StatusOK)
 			return nil
-		case http.MethodDelete:
+		default:
+			return errMethodNotAllowed
+		}
+	}
+}
+
+// GET    /users/{username}
+// PUT    /users/{username} {"password": "..."}
+// PATCH  /users/{username} {"username": "...", "disabled": true, ...}
+// DELETE /users/{username}
+// POST   /users/{username}/restore
+// GET    /users/{username}/fs?depth=...
+// POST   /users/{username}/fs/apply?prune=true&force=true&archive=true&dry_run=true
+func userHandler(m *mgr.Mgr) handlerFunc {
+	users := usersHandler(m)
+	return func(w http.ResponseWriter, r *http.Request) error {
+		path := strings.TrimPrefix(r.URL.Path, "/users/")
+		if path == "" {
+			deprecated(w, "/users")
+			return users(w, r)
+		}
+
+		username, action := path, ""
+		if i := strings.IndexByte(path, '/'); i != -1 {
+			username, action = path[:i], path[i+1:]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			if err := authorize(r, mgr.PermReadUsers); err != nil {
+				return err
+			}
+			u, err := m.Get(r.Context(), username)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, u)
+		case action == "" && r.Method == http.MethodPut:
 			var u mgr.User
-			if err := bind(r, &u); err != nil {
+			fields, err := bindUser(r, &u)
+			if err != nil {
 				return err
 			}
-			if err := m.Delete(r.Context(), &u); err != nil {
+			if u.Username != "" && u.Username != username {
+				return &mgr.Error{
+					Code:    mgr.CodeValidation,
+					Message: "username doesn't match the path, use PATCH to rename",
+				}
+			}
+			u.Username = username
+			return saveUser(w, r, m, &u, fields)
+		case action == "" && r.Method == http.MethodPatch:
+			return patchUser(w, r, m, username)
+		case action == "" && r.Method == http.MethodDelete:
+			if err := authorize(r, mgr.PermDeleteUsers); err != nil {
+				return err
+			}
+			if err := m.Delete(r.Context(), &mgr.User{Username: username}); err != nil {
 				return err
 			}
 			w.WriteHeader(http.StatusOK)
 			return nil
+		case action == "":
+			return errMethodNotAllowed
+		case action == "restore" && r.Method == http.MethodPost:
+			setRoute(w, "/users/{username}/restore")
+			if err := authorize(r, mgr.PermWriteUsers); err != nil {
+				return err
+			}
+			if err := m.Restore(r.Context(), username); err != nil {
+				return err
+			}
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		case action == "restore":
+			return errMethodNotAllowed
+		case action == "fs" && r.Method == http.MethodGet:
+			setRoute(w, "/users/{username}/fs")
+			if err := authorize(r, mgr.PermReadUsers); err != nil {
+				return err
+			}
+			depth := defaultInspectDepth
+			if v := r.URL.Query().Get("depth"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || n > maxInspectDepth {
+					return badRequest(fmt.Errorf("depth must be between 0 and %d", maxInspectDepth))
+				}
+				depth = n
+			}
+			fs, err := m.InspectFS(r.Context(), username, depth)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, fs)
+		case action == "fs":
+			return errMethodNotAllowed
+		case action == "fs/apply" && r.Method == http.MethodPost:
+			setRoute(w, "/users/{username}/fs/apply")
+			if err := authorize(r, mgr.PermFS); err != nil {
+				return err
+			}
+			var opts mgr.FSOptions
+			var err error
+			q := r.URL.Query()
+			if opts.Prune, err = queryBool(q, "prune"); err != nil {
+				return err
+			}
+			if opts.Force, err = queryBool(q, "force"); err != nil {
+				return err
+			}
+			if opts.Archive, err = queryBool(q, "archive"); err != nil {
+				return err
+			}
+			if opts.DryRun, err = queryBool(q, "dry_run"); err != nil {
+				return err
+			}
+			actions, err := m.ApplyFS(r.Context(), username, &opts)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, actionsResponse{Actions: actions})
+		case action == "fs/apply":
+			return errMethodNotAllowed
 		default:
-			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return errNotFound
+		}
+	}
+}
+
+// GET  /templates
+// POST /templates {"name": "...", "fs": {...}}
+func templatesHandler(m *mgr.Mgr) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		switch r.Method {
+		case http.MethodGet:
+			if err := authorize(r, mgr.PermReadUsers); err != nil {
+				return err
+			}
+			templates, err := m.ListTemplates(r.Context())
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, templates)
+		case http.MethodPost:
+			var t mgr.Template
+			if err := bind(r, &t); err != nil {
+				return err
+			}
+			return saveTemplate(w, r, m, &t)
+		default:
+			return errMethodNotAllowed
+		}
+	}
+}
+
+// GET    /templates/{name}
+// PUT    /templates/{name} {"fs": {...}}
+// DELETE /templates/{name}
+func templateHandler(m *mgr.Mgr) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		name := strings.TrimPrefix(r.URL.Path, "/templates/")
+		if name == "" || strings.Contains(name, "/") {
+			return errNotFound
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if err := authorize(r, mgr.PermReadUsers); err != nil {
+				return err
+			}
+			t, err := m.GetTemplate(r.Context(), name)
+			if err != nil {
+				return err
+			}
+			return writeJSON(w, http.StatusOK, t)
+		case http.MethodPut:
+			var t mgr.Template
+			if err := bind(r, &t); err != nil {
+				return err
+			}
+			if t.Name != "" && t.Name != name {
+				return &mgr.Error{Code: mgr.CodeValidation, Message: "name doesn't match the path"}
+			}
+			t.Name = name
+			return saveTemplate(w, r, m, &t)
+		case http.MethodDelete:
+			if err := authorizeTemplates(r); err != nil {
+				return err
+			}
+			if err := m.DeleteTemplate(r.Context(), name); err != nil {
+				return err
+			}
+			w.WriteHeader(http.StatusOK)
 			return nil
+		default:
+			return errMethodNotAllowed
+		}
+	}
+}
+
+// authorizeTemplates checks that the caller can change templates,
+// they're shared by all tenants, so tenant callers cannot.
+func authorizeTemplates(r *http.Request) error {
+	if err := authorize(r, mgr.PermFS); err != nil {
+		return err
+	}
+	if mgr.TenantFromContext(r.Context()) != "" {
+		return errForbidden
+	}
+	return nil
+}
+
+// saveTemplate creates or updates the template responding
+// with 201 Created or 200 OK correspondingly.
+func saveTemplate(w http.ResponseWriter, r *http.Request, m *mgr.Mgr, t *mgr.Template) error {
+	if err := authorizeTemplates(r); err != nil {
+		return err
+	}
+	created, err := m.SaveTemplate(r.Context(), t)
+	if err != nil {
+		return err
+	}
+	if created {
+		w.Header().Set("Location", "/templates/"+t.Name)
+		return writeJSON(w, http.StatusCreated, t)
+	}
+	return writeJSON(w, http.StatusOK, t)
+}
+
+// GET /audit?username=...&actor=...&since=...&until=...&limit=...
+func auditHandler(m *mgr.Mgr) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		if err := authorize(r, mgr.PermReadAudit); err != nil {
+			return err
+		}
+
+		q := r.URL.Query()
+		filter := &mgr.AuditFilter{
+			Username: q.Get("username"),
+			Actor:    q.Get("actor"),
+		}
+		var err error
+		if filter.Since, err = queryTime(q, "since"); err != nil {
+			return err
 		}
+		if filter.Until, err = queryTime(q, "until"); err != nil {
+			return err
+		}
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				return badRequest(errors.New("limit must be between 1 and 1000"))
+			}
+			filter.Limit = n
+		}
+
+		entries, err := m.Audit(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, entries)
 	}
 }
 
+// queryTime parses the optional RFC 3339 time query parameter.
+func queryTime(q url.Values, name string) (time.Time, error) {
+	v := q.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, badRequest(fmt.Errorf("%s is not a RFC 3339 time", name))
+	}
+	return t, nil
+}
+
+// defaultInspectDepth and maxInspectDepth limit levels of
+// directories below local roots returned by GET /users/{username}/fs.
+const (
+	defaultInspectDepth = 3
+	maxInspectDepth     = 32
+)
+
+// queryBool parses the optional boolean query parameter.
+func queryBool(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, badRequest(fmt.Errorf("%s is not a boolean", name))
+	}
+	return b, nil
+}
+
+type actionsResponse struct {
+	Actions []*mgr.FSAction `json:"actions"`
+}
+
+// saveUser creates or updates the user responding
+// with 201 Created or 200 OK correspondingly,
+// with dry_run=true it responds with the fs plan instead.
+func saveUser(w http.ResponseWriter, r *http.Request, m *mgr.Mgr, u *mgr.User, fields mgr.Field) error {
+	perms := []mgr.Permission{mgr.PermWriteUsers, mgr.PermPassword}
+	if u.FS != nil || u.Template != "" {
+		perms = append(perms, mgr.PermFS)
+	}
+	if err := authorize(r, perms...); err != nil {
+		return err
+	}
+	if dryRun, err := queryBool(r.URL.Query(), "dry_run"); err != nil {
+		return err
+	} else if dryRun {
+		actions, err := m.PlanFS(r.Context(), u)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, actionsResponse{Actions: actions})
+	}
+
+	created, err := m.Save(r.Context(), u, fields)
+	if err != nil {
+		return err
+	}
+	if created {
+		w.Header().Set("Location", "/users/"+u.Username)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// patchUser applies a JSON merge patch (RFC 7396) to the user, only the
+// attributes present in the patch are changed, changing username renames it.
+func patchUser(w http.ResponseWriter, r *http.Request, m *mgr.Mgr, username string) error {
+	var patch map[string]interface{}
+	if err := bind(r, &patch); err != nil {
+		return err
+	}
+
+	var fields mgr.Field
+	var perms []mgr.Permission
+	for k := range patch {
+		switch k {
+		case "username":
+			fields |= mgr.FieldUsername
+			perms = append(perms, mgr.PermWriteUsers)
+		case "password":
+			fields |= mgr.FieldPassword
+			perms = append(perms, mgr.PermPassword)
+		case "fs":
+			fields |= mgr.FieldFS
+			perms = append(perms, mgr.PermFS)
+		case "template":
+			fields |= mgr.FieldTemplate
+			perms = append(perms, mgr.PermFS)
+		case "settings":
+			fields |= mgr.FieldSettings
+			perms = append(perms, mgr.PermWriteUsers)
+		case "disabled":
+			fields |= mgr.FieldDisabled
+			perms = append(perms, mgr.PermWriteUsers)
+		default:
+			return &mgr.Error{
+				Code:    mgr.CodeValidation,
+				Message: "unknown attribute",
+				Details: map[string]interface{}{"attribute": k},
+			}
+		}
+	}
+	if err := authorize(r, perms...); err != nil {
+		return err
+	}
+
+	if err := m.Patch(r.Context(), username, fields, func(u *mgr.User) (*mgr.User, error) {
+		b, err := json.Marshal(u)
+		if err != nil {
+			return nil, err
+		}
+		var doc interface{}
+		if err = json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		if b, err = json.Marshal(mergePatch(doc, patch)); err != nil {
+			return nil, err
+		}
+
+		// the patch is well-formed json but values may be of wrong types.
+		u = &mgr.User{}
+		if err = json.Unmarshal(b, u); err != nil {
+			return nil, badRequest(err)
+		}
+		return u, nil
+	}); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// mergePatch applies the patch to the target as described in RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// deprecated marks the response as served by a deprecated route.
+func deprecated(w http.ResponseWriter, successor string) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	return err
+}
+
 func bind(r *http.Request, v interface{}) error {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return err
+		return badRequest(err)
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return badRequest(err)
+	}
+	return nil
+}
+
+// bindUser decodes the user from the request body and reports which of
+// disabled and settings are present in it, so the omitted ones are kept.
+func bindUser(r *http.Request, u *mgr.User) (mgr.Field, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 0, badRequest(err)
+	}
+	var attrs map[string]json.RawMessage
+	if err = json.Unmarshal(b, &attrs); err != nil {
+		return 0, badRequest(err)
+	}
+	if err = json.Unmarshal(b, u); err != nil {
+		return 0, badRequest(err)
+	}
+	var fields mgr.Field
+	if _, ok := attrs["disabled"]; ok {
+		fields |= mgr.FieldDisabled
+	}
+	if _, ok := attrs["settings"]; ok {
+		fields |= mgr.FieldSettings
+	}
+	return fields, nil
+}
+
+// requestError is an error of the request itself rather than of its content.
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+var (
+	errNotFound         = &requestError{http.StatusNotFound, "not_found", "not found"}
+	errMethodNotAllowed = &requestError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed"}
+)
+
+func badRequest(err error) error {
+	return &requestError{http.StatusBadRequest, "bad_request", err.Error()}
+}
+
+// errorStatuses maps mgr error codes to HTTP status codes.
+var errorStatuses = map[mgr.ErrorCode]int{
+	mgr.CodeValidation:  http.StatusUnprocessableEntity,
+	mgr.CodeNotFound:    http.StatusNotFound,
+	mgr.CodeConflict:    http.StatusConflict,
+	mgr.CodeUnavailable: http.StatusServiceUnavailable,
+	mgr.CodeInternal:    http.StatusInternalServerError,
+}
+
+// errorBody is the JSON representation of all error responses.
+type errorBody struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// writeError responds with the JSON representation of err, errors that are
+// not meant for clients are logged and reported as internal ones instead.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	body := errorBody{Code: string(mgr.CodeInternal), Message: "internal server error"}
+
+	var re *requestError
+	var me *mgr.Error
+	switch {
+	case errors.As(err, &re):
+		status, body.Code, body.Message = re.status, re.code, re.message
+	case errors.As(err, &me):
+		if code, ok := errorStatuses[me.Code]; ok {
+			status = code
+		}
+		body.Code, body.Message, body.Details = string(me.Code), me.Message, me.Details
+	default:
+		log.Printf("%s %s error: %s", r.Method, r.URL.Path, err)
+	}
+	if err = writeJSON(w, status, body); err != nil {
+		log.Printf("%s %s write error: %s", r.Method, r.URL.Path, err)
 	}
-	return json.Unmarshal(b, v)
 }
 
 type handlerFunc func(w http.ResponseWriter, r *http.Request) error
 
 func (f handlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	n := time.Now()
-	rw := &responseWriter{http.StatusOK, w}
+	rw := &responseWriter{code: http.StatusOK, caller: "-", route: "unknown", ResponseWriter: w}
 	if err := f(rw, r); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		writeError(rw, r, err)
 	}
-	log.Printf("%s %s %d %s", r.Method, r.URL.Path, rw.code, time.Since(n))
+	d := time.Since(n)
+	httpRequests.observe(r.Method, rw.route, rw.code, d)
+	log.Printf("%s %s %s %d %s", r.Method, r.URL.Path, rw.caller, rw.code, d)
 }
 
 type responseWriter struct {
-	code int
+	code   int
+	caller string
+	route  string
 	http.ResponseWriter
 }
 
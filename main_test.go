@@ -1,69 +1,369 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/amenzhinsky/vsftpdmgr/internal/testenv"
 	"github.com/amenzhinsky/vsftpdmgr/mgr"
 )
 
 func TestAll(t *testing.T) {
-	databaseURL := os.Getenv("TEST_DATABASE_URL")
-	if databaseURL == "" {
-		t.Fatal("TEST_DATABASE_URL is empty")
+	m := newTestMgr(t)
+	ts := httptest.NewServer(handler(m, &config{noAuth: true}))
+	defer ts.Close()
+
+	rs := request(t, http.MethodPost, ts.URL+"/users", strings.NewReader(`{
+		"username": "test",
+		"password": "test"
+	}`))
+
+	if rs.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /users/ code = %d, want %d", rs.StatusCode, http.StatusCreated)
 	}
 
-	root, err := ioutil.TempDir("", "")
-	if err != nil {
-		t.Fatal(err)
+	rs = request(t, http.MethodGet, ts.URL+"/users", nil)
+	testResponseContains(t, rs, "test")
+
+	rs = request(t, http.MethodPut, ts.URL+"/users/test", strings.NewReader(`{
+		"password": "changed"
+	}`))
+	testStatusCode(t, rs, http.StatusOK)
+
+	rs = request(t, http.MethodGet, ts.URL+"/users/test", nil)
+	testStatusCode(t, rs, http.StatusOK)
+	testResponseContains(t, rs, `"username":"test"`)
+
+	rs = request(t, http.MethodPatch, ts.URL+"/users/test", strings.NewReader(`{
+		"disabled": true,
+		"settings": {"write_enable": "YES"}
+	}`))
+	testStatusCode(t, rs, http.StatusOK)
+
+	rs = request(t, http.MethodGet, ts.URL+"/users/test", nil)
+	testResponseContains(t, rs, `"disabled":true,"settings":{"write_enable":"YES"}`)
+
+	for _, body := range []string{`{"disabled": "yes"}`, `{"password": 5}`, `{"fs": {"mode": "zzz"}}`} {
+		rs = request(t, http.MethodPatch, ts.URL+"/users/test", strings.NewReader(body))
+		testStatusCode(t, rs, http.StatusBadRequest)
 	}
-	defer os.RemoveAll(root)
 
-	pwdfile, err := ioutil.TempFile("", "")
+	rs = request(t, http.MethodDelete, ts.URL+"/users/test", nil)
+	testStatusCode(t, rs, http.StatusOK)
+
+	rs = request(t, http.MethodDelete, ts.URL+"/users/test", nil)
+	testStatusCode(t, rs, http.StatusNotFound)
+
+	rs = request(t, http.MethodGet, ts.URL+"/users/test", nil)
+	testStatusCode(t, rs, http.StatusNotFound)
+
+	rs = request(t, http.MethodGet, ts.URL+"/ready", nil)
+	testStatusCode(t, rs, http.StatusOK)
+	testResponseContains(t, rs, `"ready":true`)
+}
+
+func TestAuth(t *testing.T) {
+	m := newTestMgr(t)
+	secret, _, err := m.CreateToken(context.Background(), "test", mgr.RoleAdmin, "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := pwdfile.Close(); err != nil {
+
+	ts := httptest.NewServer(handler(m, &config{}))
+	defer ts.Close()
+
+	rs := request(t, http.MethodGet, ts.URL+"/health", nil)
+	testStatusCode(t, rs, http.StatusOK)
+
+	rs = request(t, http.MethodGet, ts.URL+"/users", nil)
+	testStatusCode(t, rs, http.StatusUnauthorized)
+
+	for token, code := range map[string]int{
+		"vsm_invalid": http.StatusUnauthorized,
+		secret:        http.StatusOK,
+	} {
+		r, err := http.NewRequest(http.MethodGet, ts.URL+"/users", nil)
+		if err != nil {
 			t.Fatal(err)
 		}
-		if err := os.Remove(pwdfile.Name()); err != nil {
+		r.Header.Set("Authorization", "Bearer "+token)
+		rs, err := http.DefaultClient.Do(r)
+		if err != nil {
 			t.Fatal(err)
 		}
-	}()
+		testStatusCode(t, rs, code)
+	}
+}
+
+func TestTenantMetrics(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	m := newTestMgr(t, mgr.WithUserConfigDir(configDir))
+	if _, err = m.CreateTenant(context.Background(), "tenant"); err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := m.CreateToken(context.Background(), "test", mgr.RoleReadOnly, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(handler(m, &config{}))
+	defer ts.Close()
+
+	r, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+secret)
+	rs, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStatusCode(t, rs, http.StatusOK)
+	b, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "vsftpdmgr_users 0") ||
+		strings.Contains(string(b), "vsftpdmgr_http_requests_total") {
+		t.Errorf("metrics = %q, want only users of the tenant", b)
+	}
+}
 
-	m, err := mgr.New(root, pwdfile.Name(), databaseURL)
+func TestClientCert(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := m.Clean(); err != nil {
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	b, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(b); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		DNSNames:     []string{"client.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{b}, PrivateKey: key}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	for _, tc := range []struct {
+		c     *config
+		certs []tls.Certificate
+		code  int
+		body  string
+	}{
+		{&config{}, nil, http.StatusUnauthorized, ""},
+		{&config{}, []tls.Certificate{cert}, http.StatusOK, "cert:client"},
+		{&config{clientCNs: []string{"client"}}, []tls.Certificate{cert}, http.StatusOK, "cert:client"},
+		{&config{clientSANs: []string{"client.example.com"}}, []tls.Certificate{cert}, http.StatusOK, "cert:client"},
+		{&config{clientCNs: []string{"other"}}, []tls.Certificate{cert}, http.StatusForbidden, ""},
+	} {
+		ts := httptest.NewUnstartedServer(authenticated(nil, tc.c, func(w http.ResponseWriter, r *http.Request) error {
+			_, err := w.Write([]byte(identityFromContext(r.Context()).String()))
+			return err
+		}))
+		ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		ts.StartTLS()
+
+		client := ts.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = tc.certs
+		rs, err := client.Get(ts.URL)
+		if err != nil {
 			t.Fatal(err)
 		}
-		if err := m.Close(); err != nil {
-			t.Fatal(err)
+		testStatusCode(t, rs, tc.code)
+		if tc.body != "" {
+			testResponseContains(t, rs, tc.body)
 		}
-	}()
+		ts.Close()
+	}
+}
 
-	ts := httptest.NewServer(handler(m))
-	defer ts.Close()
+func TestAuthorize(t *testing.T) {
+	for _, tc := range []struct {
+		role   mgr.Role
+		method string
+		path   string
+		body   string
+	}{
+		{mgr.RoleReadOnly, http.MethodPatch, "/users/test", `{"password": "changed"}`},
+		{mgr.RoleReadOnly, http.MethodPost, "/users/test/restore", ""},
+		{mgr.RoleOperator, http.MethodPatch, "/users/test", `{"password": "changed", "fs": {}}`},
+		{mgr.RoleOperator, http.MethodPatch, "/users/test", `{"disabled": true}`},
+		{mgr.RoleOperator, http.MethodPut, "/users/test", `{"password": "changed"}`},
+		{mgr.RoleOperator, http.MethodDelete, "/users/test", ""},
+		{mgr.RoleOperator, http.MethodDelete, "/users", `{"username": "test"}`},
+	} {
+		// all the requests are expected to be rejected
+		// before reaching the manager, so it's nil here.
+		h := userHandler(nil)
+		w := httptest.NewRecorder()
+		handlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			r = withIdentity(w, r, &identity{method: "token", name: "test", role: tc.role})
+			if r.URL.Path == "/users" {
+				return usersHandler(nil)(w, r)
+			}
+			return h(w, r)
+		}).ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
 
-	rs := request(t, http.MethodPost, ts.URL+"/users", strings.NewReader(`{
-		"username": "test",
-		"password": "test"
-	}`))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s %s as %s code = %d, want %d",
+				tc.method, tc.path, tc.body, tc.role, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+// newTestMgr creates a manager in the same environment mgr tests use.
+func newTestMgr(t *testing.T, opts ...mgr.Option) *mgr.Mgr {
+	databaseURL, root, pwdfile := testenv.New(t)
+	m, err := mgr.New(root, pwdfile, databaseURL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testenv.Cleanup(t, m)
+	return m
+}
 
-	if rs.StatusCode != http.StatusOK {
-		t.Fatalf("POST /users/ code = %d, want %d", rs.StatusCode, http.StatusOK)
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+		body string
+	}{
+		{
+			err:  bind(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{")), &mgr.User{}),
+			code: http.StatusBadRequest,
+			body: `{"code":"bad_request","message":"unexpected end of JSON input"}`,
+		},
+		{
+			err:  mgr.ErrInvalidSettings.WithDetails(map[string]interface{}{"key": "A"}),
+			code: http.StatusUnprocessableEntity,
+			body: `{"code":"validation","message":"` + mgr.ErrInvalidSettings.Message + `","details":{"key":"A"}}`,
+		},
+		{
+			err:  fmt.Errorf("restore: %w", mgr.ErrUserExists),
+			code: http.StatusConflict,
+			body: `{"code":"conflict","message":"user already exists"}`,
+		},
+		{
+			err:  errors.New(`pq: relation "users" does not exist`),
+			code: http.StatusInternalServerError,
+			body: `{"code":"internal","message":"internal server error"}`,
+		},
+	} {
+		w := httptest.NewRecorder()
+		handlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return tc.err
+		}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != tc.code {
+			t.Errorf("%v: code = %d, want %d", tc.err, w.Code, tc.code)
+		}
+		if body := w.Body.String(); body != tc.body {
+			t.Errorf("%v: body = %s, want %s", tc.err, body, tc.body)
+		}
 	}
+}
 
-	rs = request(t, http.MethodGet, ts.URL+"/users", nil)
-	testResponseContains(t, rs, "test")
+func TestMergePatch(t *testing.T) {
+	for _, tc := range []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":{"b":"c","d":"e"}}`, `{"a":{"b":null,"f":"g"}}`, `{"a":{"d":"e","f":"g"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"a":"b"}`, `{"a":{"c":null}}`, `{"a":{}}`},
+	} {
+		var target, patch interface{}
+		if err := json.Unmarshal([]byte(tc.target), &target); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(mergePatch(target, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tc.target, tc.patch, b, tc.want)
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	var m requestMetrics
+	m.observe(http.MethodGet, "/users/{username}", http.StatusOK, 20*time.Millisecond)
+	m.observe(http.MethodGet, "/users/{username}", http.StatusOK, 2*time.Second)
+	m.observe("BREW", "/users", http.StatusMethodNotAllowed, time.Millisecond)
+
+	var sb strings.Builder
+	w := &metricsWriter{bufio.NewWriter(&sb)}
+	m.writeTo(w)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE vsftpdmgr_http_request_duration_seconds histogram\n",
+		`vsftpdmgr_http_requests_total{method="other",route="/users",code="405"} 1` + "\n",
+		`vsftpdmgr_http_request_duration_seconds_bucket{method="GET",route="/users/{username}",code="200",le="0.025"} 1` + "\n",
+		`vsftpdmgr_http_request_duration_seconds_bucket{method="GET",route="/users/{username}",code="200",le="+Inf"} 2` + "\n",
+		`vsftpdmgr_http_request_duration_seconds_sum{method="GET",route="/users/{username}",code="200"} 2.02` + "\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("metrics %q don't contain %q", sb.String(), want)
+		}
+	}
 }
 
 func request(t *testing.T, method, url string, body io.Reader) *http.Response {
@@ -78,6 +378,12 @@ func request(t *testing.T, method, url string, body io.Reader) *http.Response {
 	return rs
 }
 
+func testStatusCode(t *testing.T, r *http.Response, code int) {
+	if r.StatusCode != code {
+		t.Errorf("%s %s code = %d, want %d", r.Request.Method, r.Request.URL.Path, r.StatusCode, code)
+	}
+}
+
 func testResponseContains(t *testing.T, r *http.Response, s string) {
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/vsftpdmgr/mgr"
+)
+
+// durationBuckets are upper bounds of HTTP request duration histogram buckets in seconds.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+type requestStats struct {
+	buckets []uint64 // cumulative counts per durationBuckets
+	count   uint64
+	sum     float64
+}
+
+// requestMetrics collects HTTP requests statistics, routes are path
+// templates rather than actual paths to keep the number of series low.
+type requestMetrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*requestStats
+}
+
+// httpRequests are reported by every handlerFunc.
+var httpRequests = &requestMetrics{}
+
+// knownMethods are reported as is, the rest are merged into "other",
+// since methods come from clients and can be anything.
+var knownMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+func (m *requestMetrics) observe(method, route string, code int, d time.Duration) {
+	if !knownMethods[method] {
+		method = "other"
+	}
+	k := requestKey{method: method, route: route, code: code}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestKey]*requestStats{}
+	}
+	s, ok := m.requests[k]
+	if !ok {
+		s = &requestStats{buckets: make([]uint64, len(durationBuckets))}
+		m.requests[k] = s
+	}
+	sec := d.Seconds()
+	for i, le := range durationBuckets {
+		if sec <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += sec
+}
+
+// writeTo writes the metrics sorted by labels, so the output is stable.
+func (m *requestMetrics) writeTo(w *metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	w.header("vsftpdmgr_http_requests_total", "counter", "Number of HTTP requests.")
+	for _, k := range keys {
+		w.sample("vsftpdmgr_http_requests_total", k.labels(), float64(m.requests[k].count))
+	}
+
+	w.header("vsftpdmgr_http_request_duration_seconds", "histogram", "HTTP requests duration.")
+	for _, k := range keys {
+		s := m.requests[k]
+		for i, le := range durationBuckets {
+			w.sample("vsftpdmgr_http_request_duration_seconds_bucket",
+				append(k.labels(), "le", strconv.FormatFloat(le, 'g', -1, 64)), float64(s.buckets[i]))
+		}
+		w.sample("vsftpdmgr_http_request_duration_seconds_bucket",
+			append(k.labels(), "le", "+Inf"), float64(s.count))
+		w.sample("vsftpdmgr_http_request_duration_seconds_sum", k.labels(), s.sum)
+		w.sample("vsftpdmgr_http_request_duration_seconds_count", k.labels(), float64(s.count))
+	}
+}
+
+func (k requestKey) labels() []string {
+	return []string{"method", k.method, "route", k.route, "code", strconv.Itoa(k.code)}
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single sample, labels are name-value pairs.
+func (w *metricsWriter) sample(name string, labels []string, v float64) {
+	w.WriteString(name)
+	if len(labels) != 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// gauge and counter write single sample metrics without labels.
+func (w *metricsWriter) gauge(name, help string, v float64) {
+	w.header(name, "gauge", help)
+	w.sample(name, nil, v)
+}
+
+func (w *metricsWriter) counter(name, help string, v float64) {
+	w.header(name, "counter", help)
+	w.sample(name, nil, v)
+}
+
+// summary writes a summary without quantiles, that's enough to get averages.
+func (w *metricsWriter) summary(name, help string, count uint64, sum time.Duration) {
+	w.header(name, "summary", help)
+	w.sample(name+"_sum", nil, sum.Seconds())
+	w.sample(name+"_count", nil, float64(count))
+}
+
+// GET /metrics
+func metricsHandler(m *mgr.Mgr) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		if err := authorize(r, mgr.PermReadMetrics); err != nil {
+			return err
+		}
+		s, err := m.Stats(r.Context())
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := &metricsWriter{bufio.NewWriter(w)}
+
+		// the rest describes the whole server, so tenant callers get only
+		// counts of their users, which Stats already scopes to the tenant.
+		if mgr.TenantFromContext(r.Context()) != "" {
+			mw.gauge("vsftpdmgr_users", "Number of users.", float64(s.Users))
+			mw.gauge("vsftpdmgr_disabled_users", "Number of disabled users.", float64(s.DisabledUsers))
+			return mw.Flush()
+		}
+		httpRequests.writeTo(mw)
+		mw.summary("vsftpdmgr_sync_duration_seconds", "Duration of pwdfile syncs.", s.Syncs, s.SyncDuration)
+		mw.counter("vsftpdmgr_sync_failures_total", "Number of failed pwdfile syncs.", float64(s.SyncFailures))
+		mw.summary("vsftpdmgr_lock_wait_seconds", "Time spent waiting for the manager lock.", s.LockWaits, s.LockWaitDuration)
+		mw.counter("vsftpdmgr_reconciles_total", "Number of reconciliation runs.", float64(s.Reconciles))
+		mw.counter("vsftpdmgr_reconcile_failures_total", "Number of failed reconciliation runs.", float64(s.ReconcileFailures))
+		mw.header("vsftpdmgr_reconcile_corrections_total", "counter", "Number of drifts fixed by reconciliation.")
+		for _, kind := range []string{mgr.CorrectionPwdfile, mgr.CorrectionHome, mgr.CorrectionFS} {
+			mw.sample("vsftpdmgr_reconcile_corrections_total", []string{"kind", kind}, float64(s.Corrections[kind]))
+		}
+		mw.gauge("vsftpdmgr_users", "Number of users.", float64(s.Users))
+		mw.gauge("vsftpdmgr_disabled_users", "Number of disabled users.", float64(s.DisabledUsers))
+		mw.gauge("vsftpdmgr_db_max_open_connections", "Maximum number of open database connections.", float64(s.DB.MaxOpenConnections))
+		mw.gauge("vsftpdmgr_db_open_connections", "Number of open database connections.", float64(s.DB.OpenConnections))
+		mw.gauge("vsftpdmgr_db_in_use_connections", "Number of database connections in use.", float64(s.DB.InUse))
+		mw.gauge("vsftpdmgr_db_idle_connections", "Number of idle database connections.", float64(s.DB.Idle))
+		mw.counter("vsftpdmgr_db_wait_total", "Number of waits for a database connection.", float64(s.DB.WaitCount))
+		mw.counter("vsftpdmgr_db_wait_seconds_total", "Time spent waiting for a database connection.", s.DB.WaitDuration.Seconds())
+		return mw.Flush()
+	}
+}
@@ -0,0 +1,180 @@
+package mgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ACL entry tags.
+const (
+	ACLUser  = "user"
+	ACLGroup = "group"
+)
+
+// ACLEntry grants permissions to a user or a group other than the
+// owner of a directory, the owner, its group and others get the
+// permissions of the directory mode as usual.
+type ACLEntry struct {
+	// Tag is either "user" or "group".
+	Tag string `json:"tag"`
+
+	// Name is a user or group name or a numeric id.
+	Name string `json:"name"`
+
+	// Perms is a combination of "r", "w" and "x", e.g. "rwx" or "r-x".
+	Perms string `json:"perms"`
+
+	// Default entries are not checked for the directory itself
+	// but inherited by files and directories created in it.
+	Default bool `json:"default,omitempty"`
+}
+
+// POSIX ACL extended attributes and their binary representation,
+// see acl_ea.h in the linux kernel sources.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+
+	aclVersion = 2
+
+	aclTagUserObj  = 0x01
+	aclTagUser     = 0x02
+	aclTagGroupObj = 0x04
+	aclTagGroup    = 0x08
+	aclTagMask     = 0x10
+	aclTagOther    = 0x20
+
+	aclUndefinedID = 0xffffffff
+)
+
+// errACLUnsupported is returned when ACLs cannot be used on the platform.
+var errACLUnsupported = errors.New("posix acls are not supported")
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// parseACLPerms parses permissions like "rwx", "r-x" or "rx".
+func parseACLPerms(s string) (uint16, bool) {
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, false
+		}
+	}
+	return perm, true
+}
+
+func formatACLPerms(perm uint16) string {
+	b := []byte("---")
+	if perm&4 != 0 {
+		b[0] = 'r'
+	}
+	if perm&2 != 0 {
+		b[1] = 'w'
+	}
+	if perm&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// checkACL returns the reason acl entries of an fs node
+// are not valid, an empty string means they're valid.
+func checkACL(entries []ACLEntry) string {
+	seen := make(map[ACLEntry]bool, len(entries))
+	for _, e := range entries {
+		if e.Tag != ACLUser && e.Tag != ACLGroup {
+			return "acl tag must be user or group"
+		}
+		if e.Name == "" {
+			return "acl name is blank"
+		}
+		if _, ok := parseACLPerms(e.Perms); !ok {
+			return "acl perms must consist of r, w and x"
+		}
+
+		// only one entry per user or group of each kind, whatever the perms.
+		e.Perms = ""
+		if seen[e] {
+			return "duplicate acl entry " + e.Tag + " " + e.Name
+		}
+		seen[e] = true
+	}
+	return ""
+}
+
+// buildACL returns the full ACL for the mode and the named entries,
+// the mask grants everything the named entries and the group have,
+// nil is returned when there are no named entries.
+func buildACL(mode Mode, named []aclEntry) []aclEntry {
+	if len(named) == 0 {
+		return nil
+	}
+	group := uint16(mode>>3) & 7
+	mask := group
+	for _, e := range named {
+		mask |= e.perm
+	}
+	acl := append([]aclEntry{
+		{tag: aclTagUserObj, perm: uint16(mode>>6) & 7, id: aclUndefinedID},
+		{tag: aclTagGroupObj, perm: group, id: aclUndefinedID},
+		{tag: aclTagMask, perm: mask, id: aclUndefinedID},
+		{tag: aclTagOther, perm: uint16(mode) & 7, id: aclUndefinedID},
+	}, named...)
+	sort.Slice(acl, func(i, j int) bool {
+		if acl[i].tag != acl[j].tag {
+			return acl[i].tag < acl[j].tag
+		}
+		return acl[i].id < acl[j].id
+	})
+	return acl
+}
+
+// aclMode returns the mode reported for a directory with the access acl,
+// its group permission bits reflect the mask rather than the group entry.
+func aclMode(mode Mode, acl []aclEntry) Mode {
+	for _, e := range acl {
+		if e.tag == aclTagMask {
+			return mode&^0070 | Mode(e.perm)<<3
+		}
+	}
+	return mode
+}
+
+func encodeACL(acl []aclEntry) []byte {
+	b := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(b, aclVersion)
+	for i, e := range acl {
+		binary.LittleEndian.PutUint16(b[4+8*i:], e.tag)
+		binary.LittleEndian.PutUint16(b[6+8*i:], e.perm)
+		binary.LittleEndian.PutUint32(b[8+8*i:], e.id)
+	}
+	return b
+}
+
+func decodeACL(b []byte) ([]aclEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 || binary.LittleEndian.Uint32(b) != aclVersion {
+		return nil, errors.New("malformed posix acl")
+	}
+	acl := make([]aclEntry, (len(b)-4)/8)
+	for i := range acl {
+		acl[i] = aclEntry{
+			tag:  binary.LittleEndian.Uint16(b[4+8*i:]),
+			perm: binary.LittleEndian.Uint16(b[6+8*i:]),
+			id:   binary.LittleEndian.Uint32(b[8+8*i:]),
+		}
+	}
+	return acl, nil
+}
@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package mgr
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// getxattr returns value of the extended attribute, nil when it's not set.
+// Symlinks are never followed, so links placed by users inside of local
+// roots cannot point acl changes at directories outside of them.
+func getxattr(path, name string) ([]byte, error) {
+	b := make([]byte, 256)
+	for {
+		n, err := lgetxattr(path, name, b)
+		switch err {
+		case nil:
+			return b[:n], nil
+		case syscall.ENODATA:
+			return nil, nil
+		case syscall.ERANGE:
+			b = make([]byte, 2*len(b))
+		case syscall.ENOTSUP:
+			return nil, errACLUnsupported
+		default:
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+	}
+}
+
+// setxattr sets value of the extended attribute, nil value removes it,
+// symlinks are not followed just like with getxattr.
+func setxattr(path, name string, value []byte) error {
+	var err error
+	if value == nil {
+		if err = lremovexattr(path, name); err == syscall.ENODATA {
+			return nil
+		}
+	} else {
+		err = lsetxattr(path, name, value)
+	}
+	switch err {
+	case nil:
+		return nil
+	case syscall.ENOTSUP:
+		return errACLUnsupported
+	default:
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+}
+
+// lgetxattr, lsetxattr and lremovexattr are the syscalls missing in the
+// syscall package, they act on symlinks themselves instead of targets.
+func lgetxattr(path, name string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var d unsafe.Pointer
+	if len(dest) != 0 {
+		d = unsafe.Pointer(&dest[0])
+	}
+	n, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(d), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func lsetxattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) != 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	if _, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), uintptr(v), uintptr(len(value)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func lremovexattr(path, name string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_LREMOVEXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(a)), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
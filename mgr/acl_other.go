@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package mgr
+
+// getxattr reports no acls, since there's no way to read them.
+func getxattr(path, name string) ([]byte, error) {
+	return nil, nil
+}
+
+func setxattr(path, name string, value []byte) error {
+	return errACLUnsupported
+}
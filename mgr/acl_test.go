@@ -0,0 +1,162 @@
+package mgr
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildACL(t *testing.T) {
+	if acl := buildACL(0750, nil); acl != nil {
+		t.Errorf("buildACL = %v, want nil", acl)
+	}
+	acl := buildACL(0750, []aclEntry{
+		{tag: aclTagGroup, perm: 7, id: 100},
+		{tag: aclTagUser, perm: 4, id: 2000},
+		{tag: aclTagUser, perm: 5, id: 1000},
+	})
+	want := []aclEntry{
+		{tag: aclTagUserObj, perm: 7, id: aclUndefinedID},
+		{tag: aclTagUser, perm: 5, id: 1000},
+		{tag: aclTagUser, perm: 4, id: 2000},
+		{tag: aclTagGroupObj, perm: 5, id: aclUndefinedID},
+		{tag: aclTagGroup, perm: 7, id: 100},
+		{tag: aclTagMask, perm: 7, id: aclUndefinedID},
+		{tag: aclTagOther, perm: 0, id: aclUndefinedID},
+	}
+	if !reflect.DeepEqual(acl, want) {
+		t.Fatalf("buildACL = %v, want %v", acl, want)
+	}
+	if mode := aclMode(0750, acl); mode != 0770 {
+		t.Errorf("aclMode = %s, want 0770", mode)
+	}
+
+	got, err := decodeACL(encodeACL(acl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, acl) {
+		t.Errorf("decodeACL = %v, want %v", got, acl)
+	}
+	if _, err = decodeACL([]byte{2, 0, 0, 0, 1}); err == nil {
+		t.Error("decodeACL of truncated acl succeeded")
+	}
+}
+
+func TestCheckACL(t *testing.T) {
+	for _, tc := range []struct {
+		entry ACLEntry
+		ok    bool
+	}{
+		{ACLEntry{Tag: ACLUser, Name: "ftp", Perms: "r-x"}, true},
+		{ACLEntry{Tag: ACLGroup, Name: "100", Perms: "rwx", Default: true}, true},
+		{ACLEntry{Tag: "mask", Name: "ftp", Perms: "rwx"}, false},
+		{ACLEntry{Tag: ACLUser, Perms: "rwx"}, false},
+		{ACLEntry{Tag: ACLUser, Name: "ftp", Perms: "rwt"}, false},
+	} {
+		if reason := checkACL([]ACLEntry{tc.entry}); (reason == "") != tc.ok {
+			t.Errorf("checkACL(%+v) = %q", tc.entry, reason)
+		}
+	}
+	if reason := checkACL([]ACLEntry{
+		{Tag: ACLUser, Name: "ftp", Perms: "r-x"},
+		{Tag: ACLUser, Name: "ftp", Perms: "rwx", Default: true},
+		{Tag: ACLGroup, Name: "ftp", Perms: "rwx"},
+	}); reason != "" {
+		t.Errorf("checkACL = %q, want valid", reason)
+	}
+	if reason := checkACL([]ACLEntry{
+		{Tag: ACLUser, Name: "ftp", Perms: "r-x"},
+		{Tag: ACLUser, Name: "ftp", Perms: "rwx"},
+	}); reason == "" {
+		t.Error("checkACL of duplicate entries succeeded")
+	}
+}
+
+func TestACL(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = setxattr(root, aclDefaultXattr, nil); err == errACLUnsupported {
+		t.Skip(err)
+	}
+
+	acl := []ACLEntry{
+		{Tag: ACLUser, Name: "12345", Perms: "r-x"},
+		{Tag: ACLGroup, Name: "12345", Perms: "rwx", Default: true},
+	}
+	fs := FS{Children: []FS{{Name: "a", Mode: 0750, ACL: acl}}}
+	if err = mkfs(root, fs); err != nil {
+		if err == errACLUnsupported {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if actions, err := planfs(root, fs); err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 0 {
+		t.Errorf("planfs = %v, want no actions", actions)
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got FS
+	if err = (&fsInspector{users: map[uint32]string{}, groups: map[uint32]string{}}).
+		inspect(&got, root, info, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Children) != 1 || got.Children[0].Mode != 0750 ||
+		!reflect.DeepEqual(got.Children[0].ACL, acl) {
+		t.Errorf("inspect = %+v, want mode 0750 and acl %v", got.Children, acl)
+	}
+
+	// the same user by name and id is a duplicate too.
+	if _, err = planfs(root, FS{Children: []FS{{Name: "a", ACL: []ACLEntry{
+		{Tag: ACLUser, Name: "12345", Perms: "r-x"},
+		{Tag: ACLUser, Name: "012345", Perms: "rwx"},
+	}}}}); !errors.Is(err, ErrInvalidFS) {
+		t.Errorf("planfs of duplicate entries error = %v, want %v", err, ErrInvalidFS)
+	}
+
+	// acls of directories that don't declare them are removed,
+	// except ones inherited from default entries of parents.
+	fs = FS{Children: []FS{
+		{Name: "a", Mode: 0750},
+		{Name: "b", ACL: acl[1:], Children: []FS{{Name: "c"}}},
+	}}
+	if err = mkfs(root, fs); err != nil {
+		t.Fatal(err)
+	}
+	if actions, err := planfs(root, fs); err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 0 {
+		t.Errorf("planfs = %v, want no actions", actions)
+	}
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		if b, err := getxattr(filepath.Join(root, "a"), name); err != nil || b != nil {
+			t.Errorf("getxattr(%s) = %v, %v, want no acl", name, b, err)
+		}
+	}
+	if b, err := getxattr(filepath.Join(root, "b", "c"), aclDefaultXattr); err != nil || b == nil {
+		t.Errorf("getxattr(%s) = %v, %v, want inherited acl", aclDefaultXattr, b, err)
+	}
+
+	// symlinks are not followed, so targets outside of the root are intact.
+	if err = os.Symlink(filepath.Join(root, "b"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := getxattr(filepath.Join(root, "link"), aclDefaultXattr); b != nil {
+		t.Errorf("getxattr of symlink = %v, %v, want no acl", b, err)
+	}
+	_ = setxattr(filepath.Join(root, "link"), aclDefaultXattr, nil)
+	if b, err := getxattr(filepath.Join(root, "b"), aclDefaultXattr); err != nil || b == nil {
+		t.Errorf("getxattr(%s) = %v, %v, want acl kept", aclDefaultXattr, b, err)
+	}
+}
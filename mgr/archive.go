@@ -0,0 +1,186 @@
+package mgr
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeArchive packs the src directory into a gzipped tarball at dst
+// keeping modes, ownership and modification times of all entries.
+// Missing src produces an empty archive.
+func writeArchive(src, dst string) (err error) {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == src && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return writeArchiveEntry(tw, src, path, info)
+	}); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, src, path string, info os.FileInfo) error {
+	var link string
+	switch {
+	case info.Mode().IsRegular(), info.IsDir():
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		// sockets, devices and pipes cannot appear in
+		// an ftp home directory in any meaningful way.
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(src, path)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractArchive unpacks a tarball created by writeArchive into dst,
+// which must not exist, restoring modes, ownership and modification times.
+func extractArchive(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	if err = os.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+
+	// directories may be read-only, so their modes are applied after
+	// all the content is written, symlinks are created last so no entry
+	// can be written through them to somewhere outside of dst.
+	var dirs, links []*tar.Header
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside of %q root", hdr.Name, dst)
+		}
+		hdr.Name = filepath.Join(dst, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(hdr.Name, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			if err = extractFile(tr, hdr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links = append(links, hdr)
+		}
+	}
+
+	for _, hdr := range links {
+		if err = os.Symlink(hdr.Linkname, hdr.Name); err != nil {
+			return err
+		}
+		if err = os.Lchown(hdr.Name, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+
+	// walk backwards so parents are finalized after their children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = restoreAttrs(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, hdr *tar.Header) error {
+	f, err := os.OpenFile(hdr.Name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return restoreAttrs(hdr)
+}
+
+func restoreAttrs(hdr *tar.Header) error {
+	if err := os.Lchown(hdr.Name, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(hdr.Name, hdr.FileInfo().Mode()&^os.ModeType); err != nil {
+		return err
+	}
+	return os.Chtimes(hdr.Name, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,59 @@
+package mgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err = mkfs(src, FS{
+		Mode: 0750,
+		Children: []FS{
+			{Name: "read", Mode: 0555},
+			{Name: "write", Mode: 0755},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(src, "write", "file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("write/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tgz := filepath.Join(dir, "src.tar.gz")
+	if err = writeArchive(src, tgz); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err = extractArchive(tgz, dst); err != nil {
+		t.Fatal(err)
+	}
+	testDir(t, dst, "", 0750)
+	testDir(t, dst, "read", 0555)
+	testDir(t, dst, "write", 0755)
+	testDir(t, dst, "write/file", 0640)
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "content" {
+		t.Errorf("link content = %q, want %q", b, "content")
+	}
+
+	if err = extractArchive(tgz, dst); !os.IsExist(err) {
+		t.Errorf("extractArchive to existing dir error = %v, want exist error", err)
+	}
+}
@@ -0,0 +1,192 @@
+package mgr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actor is whoever performs a mutation, it's recorded in the audit log.
+type Actor struct {
+	// Name identifies the caller, e.g. "token:backup".
+	Name string
+
+	// Addr is the caller's network address, blank for local callers.
+	Addr string
+}
+
+type actorKey struct{}
+
+// WithActor attributes mutations performed with the returned context to the actor.
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor the context is attributed to.
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// Audited actions, disable and enable are updates that toggle the disabled flag.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDisable = "disable"
+	ActionEnable  = "enable"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionRename  = "rename"
+)
+
+// updateAction returns the action an update of an existing user performs.
+func updateAction(wasDisabled, disabled bool) string {
+	switch {
+	case !wasDisabled && disabled:
+		return ActionDisable
+	case wasDisabled && !disabled:
+		return ActionEnable
+	default:
+		return ActionUpdate
+	}
+}
+
+// AuditEntry is a record of a single user mutation.
+type AuditEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Addr     string    `json:"addr,omitempty"`
+	Action   string    `json:"action"`
+	Username string    `json:"username"`
+	Tenant   string    `json:"tenant,omitempty"`
+
+	// Changes are new values of the changed fields,
+	// passwords are never recorded, only the fact of change.
+	Changes map[string]interface{} `json:"changes,omitempty"`
+}
+
+// redacted replaces secrets in audit records.
+const redacted = "[redacted]"
+
+// AuditFilter narrows down audit log entries, zero fields match everything.
+type AuditFilter struct {
+	Username string
+	Actor    string
+	Since    time.Time
+	Until    time.Time
+
+	// Limit is the maximum number of returned entries, 100 by default.
+	Limit int
+}
+
+// audit records the mutation in the transaction the mutation is performed in,
+// so there's no way to change a user without leaving a trace, webhook
+// events are queued and other instances are notified in the same
+// transaction for the same reason.
+func (m *Mgr) audit(ctx context.Context, tx *sql.Tx, action string, u *User, changes map[string]interface{}) error {
+	b, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	actor := ActorFromContext(ctx)
+	e := &AuditEntry{
+		Actor:    actor.Name,
+		Addr:     actor.Addr,
+		Action:   action,
+		Username: u.Username,
+		Tenant:   u.Tenant,
+		Changes:  changes,
+	}
+	if err = tx.QueryRowContext(ctx, `INSERT INTO audit (actor, addr, action, username, tenant, changes)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6) RETURNING id, created_at`,
+		e.Actor, e.Addr, e.Action, e.Username, e.Tenant, b).Scan(&e.ID, &e.Time); err != nil {
+		return err
+	}
+	if err = enqueueEvents(ctx, tx, e); err != nil {
+		return err
+	}
+	return m.notify(ctx, tx, e)
+}
+
+// userChanges returns audited values of the given fields of the user.
+func userChanges(u *User, fields Field) map[string]interface{} {
+	changes := map[string]interface{}{}
+	if fields&FieldPassword != 0 {
+		changes["password"] = redacted
+	}
+	if fields&FieldDisabled != 0 {
+		changes["disabled"] = u.Disabled
+	}
+	if fields&FieldSettings != 0 {
+		changes["settings"] = u.Settings
+	}
+	if fields&FieldFS != 0 && u.FS != nil {
+		changes["fs"] = u.FS
+	}
+	if fields&FieldTemplate != 0 {
+		changes["template"] = u.Template
+	}
+	return changes
+}
+
+// Audit returns audit log entries visible in the context's
+// tenant matching the filter, the most recent first.
+func (m *Mgr) Audit(ctx context.Context, filter *AuditFilter) ([]*AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	cond := func(format string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(format, len(args)))
+	}
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		cond("tenant = $%d", tenant)
+	}
+	if filter.Username != "" {
+		cond("username = $%d", filter.Username)
+	}
+	if filter.Actor != "" {
+		cond("actor = $%d", filter.Actor)
+	}
+	if !filter.Since.IsZero() {
+		cond("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		cond("created_at < $%d", filter.Until)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := `SELECT id, created_at, actor, addr, action, username, COALESCE(tenant, ''), changes FROM audit`
+	if len(where) != 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY id DESC LIMIT $%d`, len(args))
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var b []byte
+		if err = rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Addr, &e.Action,
+			&e.Username, &e.Tenant, &b); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &e.Changes); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,198 @@
+package mgr
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Diff is the difference between the database and the actual
+// state of the pwdfile and the root, all lists are sorted.
+type Diff struct {
+	// MissingUsers are enabled users absent in the pwdfile.
+	MissingUsers []string `json:"missing_users,omitempty"`
+
+	// ExtraUsers are in the pwdfile but either
+	// don't exist in the database or disabled.
+	ExtraUsers []string `json:"extra_users,omitempty"`
+
+	// PasswordMismatches are users with different password hashes.
+	PasswordMismatches []string `json:"password_mismatches,omitempty"`
+
+	// MalformedLines are numbers of pwdfile lines that are not login:hash pairs.
+	MalformedLines []int `json:"malformed_lines,omitempty"`
+
+	// DuplicateLines are numbers of pwdfile lines repeating logins of earlier
+	// lines, they're ignored since vsftpd matches the first line of a login.
+	DuplicateLines []int `json:"duplicate_lines,omitempty"`
+
+	// OrphanHomes are directories in the root, relative
+	// to it, that are not local roots of any user.
+	OrphanHomes []string `json:"orphan_homes,omitempty"`
+
+	// MissingHomes are users without local roots.
+	MissingHomes []string `json:"missing_homes,omitempty"`
+}
+
+// Empty reports whether there's no drift.
+func (d *Diff) Empty() bool {
+	return len(d.MissingUsers) == 0 && len(d.ExtraUsers) == 0 &&
+		len(d.PasswordMismatches) == 0 && len(d.MalformedLines) == 0 &&
+		len(d.DuplicateLines) == 0 && len(d.OrphanHomes) == 0 && len(d.MissingHomes) == 0
+}
+
+// Diff compares the database to the pwdfile and directories in the root,
+// e.g. to find out whether the pwdfile is edited by hand or a sync failed.
+func (m *Mgr) Diff(ctx context.Context) (*Diff, error) {
+	m.lock()
+	defer m.mu.Unlock()
+
+	users, err := m.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return m.diff(ctx, users)
+}
+
+// diff compares the given list of all users to the pwdfile and the root.
+func (m *Mgr) diff(ctx context.Context, users []*User) (*Diff, error) {
+	tenants, err := m.tenantNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, malformed, duplicate, err := readPwdfile(m.pwdfile)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Diff{MalformedLines: malformed, DuplicateLines: duplicate}
+	homes := make(map[string]bool, len(users))
+	for _, u := range users {
+		homes[m.home(u)] = true
+		if _, err := os.Stat(m.home(u)); os.IsNotExist(err) {
+			d.MissingHomes = append(d.MissingHomes, u.Username)
+		} else if err != nil {
+			return nil, err
+		}
+
+		password, ok := entries[u.Username]
+		delete(entries, u.Username)
+		switch {
+		case u.Disabled && ok:
+			d.ExtraUsers = append(d.ExtraUsers, u.Username)
+		case u.Disabled:
+		case !ok:
+			d.MissingUsers = append(d.MissingUsers, u.Username)
+		case password != u.Password:
+			d.PasswordMismatches = append(d.PasswordMismatches, u.Username)
+		}
+	}
+	for username := range entries {
+		d.ExtraUsers = append(d.ExtraUsers, username)
+	}
+
+	// tenant directories are not homes themselves, their content is checked instead.
+	dirs := []string{m.root}
+	for _, tenant := range tenants {
+		dirs = append(dirs, filepath.Join(m.root, tenant))
+	}
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			path := filepath.Join(dir, info.Name())
+			if !info.IsDir() || homes[path] || m.isServiceDir(path, dir, tenants) {
+				continue
+			}
+			rel, err := filepath.Rel(m.root, path)
+			if err != nil {
+				return nil, err
+			}
+			d.OrphanHomes = append(d.OrphanHomes, filepath.ToSlash(rel))
+		}
+	}
+
+	sort.Strings(d.MissingUsers)
+	sort.Strings(d.ExtraUsers)
+	sort.Strings(d.PasswordMismatches)
+	sort.Strings(d.OrphanHomes)
+	sort.Strings(d.MissingHomes)
+	return d, nil
+}
+
+// isServiceDir reports whether the path inside of dir is maintained by
+// the manager itself, that is a tenant directory or one of the configured
+// directories that happen to be inside of the root, or a hidden one.
+func (m *Mgr) isServiceDir(path, dir string, tenants []string) bool {
+	if strings.HasPrefix(filepath.Base(path), ".") ||
+		path == m.archiveDir || path == m.userConfigDir {
+		return true
+	}
+	if dir != m.root {
+		return false
+	}
+	for _, tenant := range tenants {
+		if filepath.Base(path) == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mgr) tenantNames(ctx context.Context) ([]string, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT name FROM tenants`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// readPwdfile parses the pwdfile into a login to password hash map,
+// comments and blank lines are skipped, numbers of malformed lines and
+// lines with logins seen before are returned separately, the first
+// line of a login wins just like in vsftpd.
+func readPwdfile(path string) (entries map[string]string, malformed, duplicate []int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	entries = map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			malformed = append(malformed, n)
+			continue
+		}
+		if _, ok := entries[line[:i]]; ok {
+			duplicate = append(duplicate, n)
+			continue
+		}
+		entries[line[:i]] = line[i+1:]
+	}
+	return entries, malformed, duplicate, s.Err()
+}
@@ -0,0 +1,38 @@
+package mgr
+
+// ErrorCode classifies errors that are safe to report to API clients.
+type ErrorCode string
+
+// Error codes, any error not being an *Error is considered internal.
+const (
+	CodeValidation  ErrorCode = "validation"
+	CodeNotFound    ErrorCode = "not_found"
+	CodeConflict    ErrorCode = "conflict"
+	CodeUnavailable ErrorCode = "unavailable"
+	CodeInternal    ErrorCode = "internal"
+)
+
+// Error is an error caused by the caller, its message and
+// details don't contain anything sensitive about the system.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]interface{}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is makes errors with attached details match the original one,
+// so they still can be checked with errors.Is.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && t.Message == e.Message
+}
+
+// WithDetails returns a copy of the error with the given details.
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
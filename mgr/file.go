@@ -0,0 +1,212 @@
+package mgr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"text/template/parse"
+)
+
+// Types of fs nodes, blank is a directory.
+const (
+	FSTypeDir  = "dir"
+	FSTypeFile = "file"
+)
+
+// maxFileContent is the maximum size of seed files content, they're meant
+// for short notes like README.txt or .message, not for uploading data.
+const maxFileContent = 64 << 10
+
+// fileData is what content templates of seed files are rendered with.
+type fileData struct {
+	Username string
+	Tenant   string
+}
+
+// Reasons content templates of seed files are rejected.
+var (
+	errContentAction   = errors.New("only {{.Username}} and {{.Tenant}} actions are allowed")
+	errContentTooLarge = errors.New("content is too large")
+)
+
+// parseContent parses the content template of a seed file, only plain
+// {{.Username}} and {{.Tenant}} actions are allowed, so rendering cannot
+// loop or call functions and the output is not much larger than the input.
+func parseContent(text string) (*template.Template, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) != 1 {
+		return nil, errors.New("templates cannot be defined")
+	}
+	for _, n := range t.Tree.Root.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			continue
+		case *parse.ActionNode:
+			if isDataField(n.Pipe) {
+				continue
+			}
+		}
+		return nil, errContentAction
+	}
+	return t, nil
+}
+
+// isDataField reports whether the pipeline is a single field of fileData.
+func isDataField(pipe *parse.PipeNode) bool {
+	if len(pipe.Decl) != 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	f, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return ok && len(f.Ident) == 1 && (f.Ident[0] == "Username" || f.Ident[0] == "Tenant")
+}
+
+// limitWriter fails writes exceeding n bytes in total.
+type limitWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		return 0, errContentTooLarge
+	}
+	w.n -= len(b)
+	return w.w.Write(b)
+}
+
+// checkFile returns the reason the node is not a valid seed file
+// or directory, an empty string means it's valid.
+func checkFile(fs FS) string {
+	switch fs.Type {
+	case "", FSTypeDir:
+		if fs.Content != "" || fs.ContentTemplate != "" {
+			return "directories cannot have content"
+		}
+		return ""
+	case FSTypeFile:
+	default:
+		return "node type must be dir or file"
+	}
+	if len(fs.Children) != 0 {
+		return "files cannot have children"
+	}
+	if len(fs.ACL) != 0 {
+		return "acls are supported for directories only"
+	}
+	if fs.Content != "" && fs.ContentTemplate != "" {
+		return "content and content template are mutually exclusive"
+	}
+	if len(fs.Content) > maxFileContent || len(fs.ContentTemplate) > maxFileContent {
+		return errContentTooLarge.Error()
+	}
+	if fs.ContentTemplate != "" {
+		if _, err := parseContent(fs.ContentTemplate); err != nil {
+			return "content template is not valid: " + err.Error()
+		}
+	}
+	return ""
+}
+
+// renderFS returns a copy of the fs tree with content templates
+// of seed files rendered with data, fs itself is never modified.
+func renderFS(fs FS, data *fileData) (FS, error) {
+	var render func(fs FS, path string) (FS, error)
+	render = func(fs FS, path string) (FS, error) {
+		if fs.ContentTemplate != "" {
+			t, err := parseContent(fs.ContentTemplate)
+			if err != nil {
+				return FS{}, invalidFS("content template is not valid: "+err.Error(), "", path)
+			}
+			var b bytes.Buffer
+			if err = t.Execute(&limitWriter{w: &b, n: maxFileContent}, data); errors.Is(err, errContentTooLarge) {
+				return FS{}, invalidFS(errContentTooLarge.Error(), "", path)
+			} else if err != nil {
+				return FS{}, invalidFS("content template cannot be rendered: "+err.Error(), "", path)
+			}
+			fs.Content, fs.ContentTemplate = b.String(), ""
+		}
+		if len(fs.Children) == 0 {
+			return fs, nil
+		}
+		children := make([]FS, len(fs.Children))
+		for i, ch := range fs.Children {
+			var err error
+			if children[i], err = render(ch, filepath.Join(path, ch.Name)); err != nil {
+				return FS{}, err
+			}
+		}
+		fs.Children = children
+		return fs, nil
+	}
+	return render(fs, "")
+}
+
+// planFile plans writing the seed file unless it already exists, existing
+// files are never changed, missing parents are created with the default mode.
+func (p *fsPlanner) planFile(path string, fs FS) error {
+	if reason := checkFile(fs); reason != "" {
+		return invalidFS(reason, p.root, path)
+	}
+	if p.written[path] {
+		return nil
+	}
+	if _, ok := p.created[path]; ok || path == p.root {
+		return invalidFS("node is not a file", p.root, path)
+	}
+	info, err := os.Lstat(path)
+	if err == nil {
+		if !info.Mode().IsRegular() {
+			return invalidFS("node is not a file", p.root, path)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = p.create(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	mode := Mode(0644)
+	if fs.Mode != 0 {
+		mode = fs.Mode
+	}
+	a := &FSAction{Action: FSActionWrite, Path: path, Mode: mode, content: []byte(fs.Content)}
+	if err = p.lookupOwner(a, path, fs); err != nil {
+		return err
+	}
+	p.written[path] = true
+	p.add(a)
+	return nil
+}
+
+// writeFile writes the seed file only if it doesn't exist,
+// so files created in the meantime are left intact.
+func writeFile(a *FSAction) error {
+	f, err := os.OpenFile(a.abs, os.O_WRONLY|os.O_CREATE|os.O_EXCL, a.Mode.FileMode())
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err = f.Write(a.content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// open is affected by umask, chmod isn't.
+	if err = os.Chmod(a.abs, a.Mode.FileMode()); err != nil {
+		return err
+	}
+	if a.uid != -1 || a.gid != -1 {
+		return os.Lchown(a.abs, a.uid, a.gid)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package mgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderFS(t *testing.T) {
+	fs := FS{Children: []FS{{Name: "a", Children: []FS{
+		{Name: "README.txt", Type: FSTypeFile, ContentTemplate: "Hello, {{.Username}}!"},
+	}}}}
+	got, err := renderFS(fs, &fileData{Username: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := got.Children[0].Children[0]; file.Content != "Hello, test!" || file.ContentTemplate != "" {
+		t.Errorf("renderFS = %+v, want rendered content", file)
+	}
+	if file := fs.Children[0].Children[0]; file.Content != "" {
+		t.Errorf("renderFS modified the tree: %+v", file)
+	}
+
+	for _, text := range []string{
+		"{{.Password}}",
+		"{{range .Username}}{{end}}",
+		"{{with .Username}}{{.}}{{end}}",
+		`{{define "a"}}{{.Username}}{{end}}{{template "a" .}}`,
+		`{{printf "%999999999d" 1}}`,
+		"{{$u := .Username}}{{$u}}",
+		strings.Repeat("a", maxFileContent-2) + "{{.Username}}",
+	} {
+		fs.Children[0].Children[0].ContentTemplate = text
+		if _, err = renderFS(fs, &fileData{Username: "test"}); err == nil {
+			t.Errorf("renderFS(%.32q) succeeded", text)
+		}
+	}
+}
+
+func TestSeedFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = ioutil.WriteFile(filepath.Join(root, ".message"), []byte("custom"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := FS{Children: []FS{
+		{Name: ".message", Type: FSTypeFile, Content: "welcome"},
+		{Name: "a/b/README.txt", Type: FSTypeFile, Mode: 0600, Content: "readme"},
+		{Name: "a", Mode: 0700},
+	}}
+	if err = mkfs(root, fs); err != nil {
+		t.Fatal(err)
+	}
+	testDir(t, root, "a", 0700)
+	testDir(t, root, "a/b", 0755)
+	testDir(t, root, "a/b/README.txt", 0600)
+	testDir(t, root, ".message", 0600)
+	for name, want := range map[string]string{
+		".message":       "custom",
+		"a/b/README.txt": "readme",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		} else if string(b) != want {
+			t.Errorf("%s content = %q, want %q", name, b, want)
+		}
+	}
+	if actions, err := planfs(root, fs); err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 0 {
+		t.Errorf("planfs = %v, want no actions", actions)
+	}
+
+	// files cannot replace directories and vice versa.
+	for _, fs := range []FS{
+		{Children: []FS{{Name: "a", Type: FSTypeFile}}},
+		{Children: []FS{{Name: ".message"}}},
+		{Children: []FS{{Name: "c", Type: FSTypeFile}, {Name: "c/d"}}},
+	} {
+		if _, err = planfs(root, fs); err == nil {
+			t.Errorf("planfs(%+v) succeeded", fs)
+		}
+	}
+}
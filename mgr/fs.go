@@ -1,103 +1,888 @@
 package mgr
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-// FS is file system tree.
+// FS is file system tree, nodes are directories unless they're seed files.
 type FS struct {
 	Name     string `json:"name"`
-	Mode     uint   `json:"mode"`
+	Type     string `json:"type,omitempty"`
+	Mode     Mode   `json:"mode,omitempty"`
 	Owner    string `json:"owner"`
 	Group    string `json:"group"`
 	Children []FS   `json:"children"`
+
+	// ACL grants permissions to users and groups besides the owner.
+	ACL []ACLEntry `json:"acl,omitempty"`
+
+	// Content of seed files is either given as is or rendered
+	// from a text/template with the user's username and tenant.
+	Content         string `json:"content,omitempty"`
+	ContentTemplate string `json:"content_template,omitempty"`
 }
 
-// mkfs creates a real file system representation of fs inside of root,
-// hence fs.Name is replaced with the root value.
-func mkfs(root string, fs FS, first bool) error {
-	if first {
-		if fs.Name != "" {
-			return errors.New("name must be blank for root node")
+// UnmarshalJSON implements the json.Unmarshaler interface,
+// owner and group can also be given as numeric ids.
+func (fs *FS) UnmarshalJSON(b []byte) error {
+	type plain FS
+	v := struct {
+		*plain
+		Owner ownerID `json:"owner"`
+		Group ownerID `json:"group"`
+	}{plain: (*plain)(fs)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	fs.Owner, fs.Group = string(v.Owner), string(v.Group)
+	return nil
+}
+
+// ownerID is a user or group name or a numeric id.
+type ownerID string
+
+func (id *ownerID) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var n uint32
+	if err := json.Unmarshal(b, &n); err == nil {
+		*id = ownerID(strconv.FormatUint(uint64(n), 10))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("owner and group must be names or numeric ids")
+	}
+	*id = ownerID(s)
+	return nil
+}
+
+// ErrInvalidFS is returned when the fs tree cannot be created,
+// the reason and the offending node are reported in details.
+var ErrInvalidFS = &Error{Code: CodeValidation, Message: "fs is not valid"}
+
+// invalidFS reports the node path relative to root,
+// so the real location on the server is not exposed.
+func invalidFS(reason, root, path string) error {
+	name, err := filepath.Rel(root, path)
+	if err != nil {
+		name = filepath.Base(path)
+	}
+	return ErrInvalidFS.WithDetails(map[string]interface{}{
+		"reason": reason,
+		"name":   name,
+	})
+}
+
+// checkFS validates structure of the fs tree without touching the file system,
+// so invalid specs are rejected before they're stored, mkfs checks the rest.
+func checkFS(fs FS) error {
+	if fs.Name != "" {
+		return invalidFS("name must be blank for root node", "", fs.Name)
+	}
+	if fs.Type != "" && fs.Type != FSTypeDir {
+		return invalidFS("root node must be a directory", "", "")
+	}
+	if reason := checkACL(fs.ACL); reason != "" {
+		return invalidFS(reason, "", "")
+	}
+	return checkFSChildren(fs.Children, "")
+}
+
+func checkFSChildren(children []FS, dir string) error {
+	for _, ch := range children {
+		if ch.Name == "" {
+			return invalidFS("node name is blank", "", dir)
+		}
+		path := filepath.Join(dir, ch.Name)
+		if path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+			return invalidFS("node is outside of the root", "", path)
+		}
+		if reason := checkACL(ch.ACL); reason != "" {
+			return invalidFS(reason, "", path)
+		}
+		if reason := checkFile(ch); reason != "" {
+			return invalidFS(reason, "", path)
 		}
+		if err := checkFSChildren(ch.Children, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalFS encodes the fs tree for the fs column, nil is stored as NULL.
+func marshalFS(fs *FS) (interface{}, error) {
+	if fs == nil {
+		return nil, nil
+	}
+	return json.Marshal(fs)
+}
+
+func unmarshalFS(b []byte) (*FS, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var fs FS
+	if err := json.Unmarshal(b, &fs); err != nil {
+		return nil, err
+	}
+	return &fs, nil
+}
 
-		// TODO: avoid modifying fs in case we use pointer here
-		fs.Name = root
+// applyFS creates the user's local root along with the stored fs tree,
+// it's idempotent so it can be re-run any time, e.g. after a restore.
+func (m *Mgr) applyFS(ctx context.Context, u *User) error {
+	actions, err := m.planFS(ctx, u, &FSOptions{})
+	if err != nil {
+		return err
 	}
+	return applyfs(actions)
+}
 
+// planFS returns actions bringing the user's local root in line with
+// the stored fs tree, nothing is changed on the file system.
+func (m *Mgr) planFS(ctx context.Context, u *User, opts *FSOptions) ([]*FSAction, error) {
+	fs, err := m.resolveFS(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if fs, err = renderFS(fs, &fileData{Username: u.Username, Tenant: u.Tenant}); err != nil {
+		return nil, err
+	}
+	actions, err := planfs(m.home(u), fs)
+	if err != nil || !opts.Prune {
+		return actions, err
+	}
+	pruned, err := m.prunefs(u, fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(actions, pruned...), nil
+}
+
+// mkfs creates a real file system representation of fs inside of root,
+// hence fs.Name has to be blank.
+func mkfs(root string, fs FS) error {
+	actions, err := planfs(root, fs)
+	if err != nil {
+		return err
+	}
+	return applyfs(actions)
+}
+
+// fsPlanner computes actions creating an fs tree inside of root,
+// directories planned to be created are tracked along with their
+// modes, so nodes declared more than once are created only once,
+// the same goes for seed files. Directories declaring default acl
+// entries are tracked too, since directories below inherit them.
+type fsPlanner struct {
+	root     string
+	created  map[string]Mode
+	written  map[string]bool
+	defaults map[string]bool
+	actions  []*FSAction
+}
+
+// planfs returns actions mkfs takes to create fs inside of root
+// in the order they have to be taken without touching anything.
+func planfs(root string, fs FS) ([]*FSAction, error) {
+	if fs.Name != "" {
+		return nil, invalidFS("name must be blank for root node", root, filepath.Join(root, fs.Name))
+	}
+	if fs.Type != "" && fs.Type != FSTypeDir {
+		return nil, invalidFS("root node must be a directory", root, root)
+	}
+	p := &fsPlanner{
+		root:     root,
+		created:  map[string]Mode{},
+		written:  map[string]bool{},
+		defaults: map[string]bool{},
+	}
+	if err := p.plan(root, fs); err != nil {
+		return nil, err
+	}
+	return p.actions, nil
+}
+
+func (p *fsPlanner) plan(path string, fs FS) error {
 	// check that directory is to create within the root.
-	fs.Name = filepath.Clean(fs.Name)
-	if !strings.HasPrefix(fs.Name, root) {
-		return fmt.Errorf("%s is outside of %q root", fs.Name, root)
+	path = filepath.Clean(path)
+	if path != p.root && !strings.HasPrefix(path, p.root+string(filepath.Separator)) {
+		return invalidFS("node is outside of the root", p.root, path)
+	}
+	switch fs.Type {
+	case "", FSTypeDir:
+	case FSTypeFile:
+		return p.planFile(path, fs)
+	default:
+		return invalidFS("node type must be dir or file", p.root, path)
 	}
 
-	mode := os.FileMode(0755)
+	mode := Mode(0755)
 	if fs.Mode != 0 {
-		mode = os.FileMode(fs.Mode)
+		mode = fs.Mode
 	}
 
-	if err := os.MkdirAll(fs.Name, mode); err != nil && !os.IsExist(err) {
+	info, exists, err := p.stat(path)
+	if err != nil {
 		return err
 	}
 
-	// we can skip chmod here when we know that MkdirAll succeeds.
-	if fs.Mode != 0 {
-		if err := os.Chmod(fs.Name, os.FileMode(fs.Mode)); err != nil {
+	// acls are based on the current mode when it's not declared,
+	// since the base entries of an access acl replace the mode bits.
+	if fs.Mode == 0 && info != nil && len(fs.ACL) != 0 {
+		if mode, err = currentMode(path, info); err != nil {
+			return err
+		}
+	}
+	access, def, err := p.resolveACL(path, mode, fs.ACL)
+	if err != nil {
+		return err
+	}
+
+	chmod := false
+	switch {
+	case !exists:
+		if err = p.create(path, mode); err != nil {
 			return err
 		}
+	case fs.Mode == 0:
+	case info == nil && p.created[path] != mode:
+		p.created[path] = mode
+		p.add(&FSAction{Action: FSActionChmod, Path: path, Mode: mode})
+		chmod = true
+	case info != nil && modeOf(info.Mode()) != aclMode(mode, access):
+		chmod = true
+		p.add(&FSAction{
+			Action: FSActionChmod,
+			Path:   path,
+			Mode:   mode,
+			Reason: "mode is " + modeOf(info.Mode()).String(),
+		})
 	}
 
 	if fs.Owner != "" || fs.Group != "" {
-		stat, err := os.Stat(fs.Name)
-		if err != nil {
+		a := &FSAction{Action: FSActionChown, Path: path}
+		if err = p.lookupOwner(a, path, fs); err != nil {
+			return err
+		}
+
+		// directories to be created are chowned unconditionally.
+		if info == nil {
+			p.add(a)
+		} else {
+			sys := info.Sys().(*syscall.Stat_t)
+			if (a.uid != -1 && a.uid != int(sys.Uid)) || (a.gid != -1 && a.gid != int(sys.Gid)) {
+				a.Reason = fmt.Sprintf("owned by %d:%d", sys.Uid, sys.Gid)
+				p.add(a)
+			}
+		}
+	}
+
+	if len(fs.ACL) != 0 {
+		if err = p.planACL(path, info, fs.ACL, access, def, chmod); err != nil {
+			return err
+		}
+		if def != nil {
+			p.defaults[path] = true
+		}
+	} else if info != nil {
+		if err = p.planACLRemoval(path); err != nil {
+			return err
+		}
+	}
+
+	// recursively plan children
+	for _, ch := range fs.Children {
+		if ch.Name == "" {
+			return invalidFS("node name is blank", p.root, path)
+		}
+		if err := p.plan(filepath.Join(path, ch.Name), ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupOwner sets owner and group of the action to the node's ones,
+// the unset ones are left unchanged.
+func (p *fsPlanner) lookupOwner(a *FSAction, path string, fs FS) error {
+	var err error
+	a.uid, a.gid = -1, -1
+	if fs.Owner != "" {
+		if a.uid, err = lookupUID(fs.Owner); err != nil {
+			if _, ok := err.(user.UnknownUserError); ok {
+				return invalidFS("unknown owner "+fs.Owner, p.root, path)
+			}
+			return err
+		}
+		a.Owner = fs.Owner
+	}
+	if fs.Group != "" {
+		if a.gid, err = lookupGID(fs.Group); err != nil {
+			if _, ok := err.(user.UnknownGroupError); ok {
+				return invalidFS("unknown group "+fs.Group, p.root, path)
+			}
+			return err
+		}
+		a.Group = fs.Group
+	}
+	return nil
+}
+
+// resolveACL returns the access and default acls of the directory
+// with the mode, nil ones mean there are no named entries of the kind.
+func (p *fsPlanner) resolveACL(path string, mode Mode, entries []ACLEntry) (access, def []aclEntry, err error) {
+	var named, defNamed []aclEntry
+	type key struct {
+		tag uint16
+		id  uint32
+		def bool
+	}
+	seen := map[key]bool{}
+	for _, e := range entries {
+		if reason := checkACL([]ACLEntry{e}); reason != "" {
+			return nil, nil, invalidFS(reason, p.root, path)
+		}
+		perm, _ := parseACLPerms(e.Perms)
+		entry := aclEntry{perm: perm}
+		var id int
+		if e.Tag == ACLUser {
+			entry.tag = aclTagUser
+			if id, err = lookupUID(e.Name); err != nil {
+				if _, ok := err.(user.UnknownUserError); ok {
+					return nil, nil, invalidFS("unknown acl user "+e.Name, p.root, path)
+				}
+				return nil, nil, err
+			}
+		} else {
+			entry.tag = aclTagGroup
+			if id, err = lookupGID(e.Name); err != nil {
+				if _, ok := err.(user.UnknownGroupError); ok {
+					return nil, nil, invalidFS("unknown acl group "+e.Name, p.root, path)
+				}
+				return nil, nil, err
+			}
+		}
+		entry.id = uint32(id)
+
+		// names and numeric ids of the same user or group
+		// are only known to be duplicates once resolved.
+		k := key{tag: entry.tag, id: entry.id, def: e.Default}
+		if seen[k] {
+			return nil, nil, invalidFS("duplicate acl entry "+e.Tag+" "+e.Name, p.root, path)
+		}
+		seen[k] = true
+		if e.Default {
+			defNamed = append(defNamed, entry)
+		} else {
+			named = append(named, entry)
+		}
+	}
+	return buildACL(mode, named), buildACL(mode, defNamed), nil
+}
+
+// currentMode returns mode of the existing directory, its group bits are
+// taken from the access acl if any, since the mode reports the mask instead.
+func currentMode(path string, info os.FileInfo) (Mode, error) {
+	mode := modeOf(info.Mode())
+	b, err := getxattr(path, aclAccessXattr)
+	if err != nil || b == nil {
+		return mode, err
+	}
+	acl, err := decodeACL(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range acl {
+		if e.tag == aclTagGroupObj {
+			mode = mode&^0070 | Mode(e.perm)<<3
+		}
+	}
+	return mode, nil
+}
+
+// planACL plans setting acls of the directory when they differ from the
+// current ones, created and chmoded directories get them unconditionally,
+// because chmod changes the base entries of the access acl.
+func (p *fsPlanner) planACL(path string, info os.FileInfo, entries []ACLEntry, access, def []aclEntry, force bool) error {
+	a := &FSAction{Action: FSActionSetACL, Path: path, ACL: entries}
+	if access != nil {
+		a.access = encodeACL(access)
+	}
+	if def != nil {
+		a.def = encodeACL(def)
+	}
+	if info == nil || force {
+		p.add(a)
+		return nil
+	}
+	curAccess, err := getxattr(path, aclAccessXattr)
+	if err != nil {
+		return err
+	}
+	curDef, err := getxattr(path, aclDefaultXattr)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(curAccess, a.access) || !bytes.Equal(curDef, a.def) {
+		a.Reason = "acl differs"
+		p.add(a)
+	}
+	return nil
+}
+
+// planACLRemoval plans removing acls of the existing directory that doesn't
+// declare any, unless they're inherited from default entries of a parent.
+func (p *fsPlanner) planACLRemoval(path string) error {
+	for dir := path; dir != p.root; {
+		dir = filepath.Dir(dir)
+		if p.defaults[dir] {
+			return nil
+		}
+	}
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		b, err := getxattr(path, name)
+		if err == errACLUnsupported {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if b != nil {
+			p.add(&FSAction{Action: FSActionSetACL, Path: path, Reason: "acl is not declared"})
+			return nil
+		}
+	}
+	return nil
+}
+
+// lookupUID and lookupGID resolve names to ids, numeric names are ids
+// themselves and not looked up at all, so owners that exist only on
+// the host can be used when the manager runs in a container.
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// stat returns info of the existing directory, info is nil
+// but exists is true when the directory is planned to be created.
+func (p *fsPlanner) stat(path string) (info os.FileInfo, exists bool, err error) {
+	if p.written[path] {
+		return nil, false, invalidFS("node is not a directory", p.root, path)
+	}
+	if _, ok := p.created[path]; ok {
+		return nil, true, nil
+	}
+	info, err = os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if !info.IsDir() {
+		return nil, false, invalidFS("node is not a directory", p.root, path)
+	}
+	return info, true, nil
+}
+
+// create plans creating the directory along with all its missing parents
+// inside of the root, they all get the same mode just like with MkdirAll.
+func (p *fsPlanner) create(path string, mode Mode) error {
+	var missing []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, exists, err := p.stat(dir); err != nil {
 			return err
+		} else if exists {
+			break
 		}
-		sys := stat.Sys().(*syscall.Stat_t)
-		uid := int(sys.Uid)
-		gid := int(sys.Gid)
-		if fs.Owner != "" {
-			u, err := user.Lookup(fs.Owner)
-			if err != nil {
-				return err
+		missing = append(missing, dir)
+		if dir == p.root {
+			break
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		p.created[missing[i]] = mode
+		p.add(&FSAction{Action: FSActionCreate, Path: missing[i], Mode: mode})
+	}
+	return nil
+}
+
+// add appends the action keeping the absolute path
+// and reporting the path relative to the root.
+func (p *fsPlanner) add(a *FSAction) {
+	a.abs = a.Path
+	if rel, err := filepath.Rel(p.root, a.Path); err == nil {
+		a.Path = filepath.ToSlash(rel)
+	}
+	p.actions = append(p.actions, a)
+}
+
+// applyfs takes the planned actions in order.
+func applyfs(actions []*FSAction) error {
+	for _, a := range actions {
+		var err error
+		switch a.Action {
+		case FSActionCreate:
+			if err = os.MkdirAll(a.abs, a.Mode.FileMode()); err == nil {
+				// mkdir is affected by umask, chmod isn't.
+				err = os.Chmod(a.abs, a.Mode.FileMode())
+			}
+		case FSActionChmod:
+			err = os.Chmod(a.abs, a.Mode.FileMode())
+		case FSActionChown:
+			err = os.Lchown(a.abs, a.uid, a.gid)
+		case FSActionSetACL:
+			if err = setxattr(a.abs, aclAccessXattr, a.access); err == nil {
+				err = setxattr(a.abs, aclDefaultXattr, a.def)
 			}
-			uid, err = strconv.Atoi(u.Uid)
-			if err != nil {
-				return err
+		case FSActionWrite:
+			err = writeFile(a)
+		case FSActionArchive:
+			if err = writeArchive(a.abs, a.archive); err == nil {
+				err = removeDir(a)
 			}
+		case FSActionRemove:
+			err = removeDir(a)
+		}
+		if err != nil {
+			return err
 		}
-		if fs.Group != "" {
-			g, err := user.LookupGroup(fs.Group)
-			if err != nil {
-				return err
+	}
+	return nil
+}
+
+// removeDir removes the pruned directory, only forced removals delete
+// its content, so files added after planning fail non-forced ones.
+func removeDir(a *FSAction) error {
+	if a.forced {
+		return os.RemoveAll(a.abs)
+	}
+	return os.Remove(a.abs)
+}
+
+// FSOptions control how directories absent in the fs spec are treated.
+type FSOptions struct {
+	// Prune removes directories that are not declared in the spec,
+	// non-empty ones are kept unless Force is set.
+	Prune bool
+	Force bool
+
+	// Archive packs pruned directories to the archive dir before
+	// removing them, requires the manager created WithArchiveDir.
+	Archive bool
+
+	// DryRun only plans actions without taking them.
+	DryRun bool
+}
+
+// Actions taken on directories of local roots.
+const (
+	FSActionCreate  = "create"
+	FSActionChmod   = "chmod"
+	FSActionChown   = "chown"
+	FSActionSetACL  = "setacl"
+	FSActionWrite   = "write"
+	FSActionRemove  = "remove"
+	FSActionArchive = "archive"
+	FSActionSkip    = "skip"
+)
+
+// FSAction is an action taken on a directory or a seed file of the local root.
+type FSAction struct {
+	Action string `json:"action"`
+
+	// Path is relative to the local root.
+	Path string `json:"path"`
+
+	// Mode is the mode of created and chmoded directories and written files.
+	Mode Mode `json:"mode,omitempty"`
+
+	// Owner and Group are new owners of chowned directories,
+	// blank ones are left unchanged.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// ACL is the new acl of directories acls are set on.
+	ACL []ACLEntry `json:"acl,omitempty"`
+
+	// Archive is the tarball name in the archive dir.
+	Archive string `json:"archive,omitempty"`
+
+	// Reason describes the current state of changed
+	// directories and explains skipped ones.
+	Reason string `json:"reason,omitempty"`
+
+	abs      string // absolute path
+	archive  string // absolute tarball path
+	uid, gid int    // -1 keeps the current owner
+	access   []byte // access acl xattr, nil removes it
+	def      []byte // default acl xattr, nil removes it
+	content  []byte // content of the written file
+	forced   bool   // removal of a non-empty directory is allowed
+}
+
+// ErrArchiveDisabled is returned when archiving is requested
+// but the manager is created without an archive dir.
+var ErrArchiveDisabled = &Error{Code: CodeValidation, Message: "archive dir is not configured"}
+
+// declaredPaths returns paths of all nodes of the fs tree relative to the
+// root, including intermediate directories of nested names like "a/b", and
+// paths of directories declaring subdirectories, the root is always one.
+func declaredPaths(fs FS) (paths, parents map[string]bool) {
+	paths, parents = map[string]bool{}, map[string]bool{".": true}
+	var walk func(dir string, children []FS)
+	walk = func(dir string, children []FS) {
+		for _, ch := range children {
+			path := filepath.Join(dir, ch.Name)
+			for p := path; p != "." && !paths[p]; p = filepath.Dir(p) {
+				paths[p] = true
 			}
-			gid, err = strconv.Atoi(g.Gid)
-			if err != nil {
-				return err
+			if ch.Type != FSTypeFile {
+				for p := path; p != "."; p = filepath.Dir(p) {
+					parents[filepath.Dir(p)] = true
+				}
 			}
+			walk(path, ch.Children)
+		}
+	}
+	walk(".", fs.Children)
+	return paths, parents
+}
+
+// prunefs plans removing directories of the user's local root not declared
+// in fs, subdirectories of removed ones are not reported separately.
+// Only directories next to declared subdirectories are pruned, content of
+// directories declaring none belongs to users, e.g. folders of uploads.
+func (m *Mgr) prunefs(u *User, fs FS, opts *FSOptions) ([]*FSAction, error) {
+	root := m.home(u)
+	declared, parents := declaredPaths(fs)
+	actions := []*FSAction{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || !info.IsDir() {
+			return nil
 		}
-		if err = os.Lchown(fs.Name, uid, gid); err != nil {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
 			return err
 		}
+		if declared[rel] {
+			return nil
+		}
+		if !parents[filepath.Dir(rel)] {
+			return filepath.SkipDir
+		}
+		a, err := m.prune(u, path, rel, opts)
+		if err != nil {
+			return err
+		}
+		actions = append(actions, a)
+		return filepath.SkipDir
+	})
+	return actions, err
+}
+
+func (m *Mgr) prune(u *User, path, rel string, opts *FSOptions) (*FSAction, error) {
+	a := &FSAction{Action: FSActionRemove, Path: filepath.ToSlash(rel), abs: path, forced: opts.Force}
+	empty, err := isEmptyDir(path)
+	if err != nil {
+		return nil, err
 	}
+	if !empty && !opts.Force {
+		a.Action, a.Reason = FSActionSkip, "directory is not empty"
+		return a, nil
+	}
+	if opts.Archive {
+		a.Action = FSActionArchive
+		a.Archive = fmt.Sprintf("%s-%s-%d.tar.gz", u.Username,
+			strings.ReplaceAll(a.Path, "/", "_"), time.Now().UnixNano())
+		a.archive = filepath.Join(m.archiveDir, a.Archive)
+	}
+	return a, nil
+}
 
-	// recursively create children
-	for _, ch := range fs.Children {
-		if ch.Name == "" {
-			return errors.New("node name is blank")
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// ErrLocalRootNotFound is returned when the user's local root is missing.
+var ErrLocalRootNotFound = &Error{Code: CodeNotFound, Message: "local root not found"}
+
+// InspectFS returns the actual directory tree of the user's local root in
+// the fs spec shape, depth limits how many levels below the root are read.
+// Owners and groups unknown to the system are reported as numeric ids,
+// regular files are reported as file nodes without content, other kinds
+// of files like symlinks are left out. It reads the tree without locking, so concurrent changes may be seen
+// partially, directories removed in the meantime are left out.
+func (m *Mgr) InspectFS(ctx context.Context, username string, depth int) (*FS, error) {
+	u, err := m.get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	root := m.home(u)
+	info, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		return nil, ErrLocalRootNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	fs := &FS{}
+	if err = (&fsInspector{users: map[uint32]string{}, groups: map[uint32]string{}}).
+		inspect(fs, root, info, depth); os.IsNotExist(err) {
+		return nil, ErrLocalRootNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// fsInspector caches resolved owners and groups, since most
+// directories of a local root share the same ones.
+type fsInspector struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func (i *fsInspector) inspect(fs *FS, path string, info os.FileInfo, depth int) error {
+	sys := info.Sys().(*syscall.Stat_t)
+	fs.Mode = modeOf(info.Mode())
+	fs.Owner = i.owner(sys.Uid)
+	fs.Group = i.group(sys.Gid)
+	if err := i.acl(fs, path); err != nil {
+		return err
+	}
+	if depth <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			sys := info.Sys().(*syscall.Stat_t)
+			fs.Children = append(fs.Children, FS{
+				Name:  info.Name(),
+				Type:  FSTypeFile,
+				Mode:  modeOf(info.Mode()),
+				Owner: i.owner(sys.Uid),
+				Group: i.group(sys.Gid),
+			})
+			continue
 		}
+		if !info.IsDir() {
+			continue
+		}
+		ch := FS{Name: info.Name()}
+		if err = i.inspect(&ch, filepath.Join(path, ch.Name), info, depth-1); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fs.Children = append(fs.Children, ch)
+	}
+	return nil
+}
 
-		// TODO: avoid modifying ch in case we use pointer here
-		ch.Name = filepath.Join(fs.Name, ch.Name)
-		if err := mkfs(root, ch, false); err != nil {
+// acl reads named entries of the directory acls, the mode's group bits
+// are replaced with the group entry, so the result can be applied back.
+func (i *fsInspector) acl(fs *FS, path string) error {
+	for _, name := range []string{aclAccessXattr, aclDefaultXattr} {
+		b, err := getxattr(path, name)
+		if err == errACLUnsupported {
+			return nil
+		} else if err != nil || b == nil {
+			return err
+		}
+		acl, err := decodeACL(b)
+		if err != nil {
 			return err
 		}
+		for _, e := range acl {
+			entry := ACLEntry{Perms: formatACLPerms(e.perm), Default: name == aclDefaultXattr}
+			switch e.tag {
+			case aclTagUser:
+				entry.Tag, entry.Name = ACLUser, i.owner(e.id)
+			case aclTagGroup:
+				entry.Tag, entry.Name = ACLGroup, i.group(e.id)
+			case aclTagGroupObj:
+				if name == aclAccessXattr {
+					fs.Mode = fs.Mode&^0070 | Mode(e.perm)<<3
+				}
+				continue
+			default:
+				continue
+			}
+			fs.ACL = append(fs.ACL, entry)
+		}
 	}
 	return nil
 }
+
+func (i *fsInspector) owner(uid uint32) string {
+	name, ok := i.users[uid]
+	if !ok {
+		name = strconv.FormatUint(uint64(uid), 10)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		i.users[uid] = name
+	}
+	return name
+}
+
+func (i *fsInspector) group(gid uint32) string {
+	name, ok := i.groups[gid]
+	if !ok {
+		name = strconv.FormatUint(uint64(gid), 10)
+		if g, err := user.LookupGroupId(name); err == nil {
+			name = g.Name
+		}
+		i.groups[gid] = name
+	}
+	return name
+}
@@ -1,9 +1,13 @@
 package mgr
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -33,7 +37,7 @@ func TestMkfs(t *testing.T) {
 		},
 	}
 
-	if err := mkfs(root, fs, true); err != nil {
+	if err := mkfs(root, fs); err != nil {
 		t.Fatal(err)
 	}
 
@@ -43,6 +47,190 @@ func TestMkfs(t *testing.T) {
 	testDir(t, root, "a/c", 0755)
 }
 
+func TestPlanfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = os.Mkdir(filepath.Join(root, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := FS{
+		Children: []FS{
+			{Name: "a", Mode: 0755},
+			{Name: "b/c", Mode: 0755},
+			{Name: "b", Mode: 0700},
+		},
+	}
+	actions, err := planfs(root, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range actions {
+		got = append(got, fmt.Sprintf("%s %s %#o", a.Action, a.Path, a.Mode))
+	}
+	want := []string{"chmod a 0755", "create b 0755", "create b/c 0755", "chmod b 0700"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("planfs = %q, want %q", got, want)
+	}
+	testDir(t, root, "a", 0700)
+	if _, err = os.Stat(filepath.Join(root, "b")); !os.IsNotExist(err) {
+		t.Errorf("planfs created a directory: %v", err)
+	}
+
+	if err = applyfs(actions); err != nil {
+		t.Fatal(err)
+	}
+	testDir(t, root, "a", 0755)
+	testDir(t, root, "b", 0700)
+	testDir(t, root, "b/c", 0755)
+	if actions, err = planfs(root, fs); err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 0 {
+		t.Errorf("planfs = %v, want no actions", actions)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err = mkfs(root, FS{
+		Mode:     0750,
+		Children: []FS{{Name: "a/b", Mode: 0700}, {Name: "c", Mode: 0555}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	usr, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	grp, err := user.LookupGroupId(usr.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got FS
+	i := &fsInspector{users: map[uint32]string{}, groups: map[uint32]string{}}
+	if err = i.inspect(&got, root, info, 1); err != nil {
+		t.Fatal(err)
+	}
+	node := func(name string, mode Mode) FS {
+		return FS{Name: name, Mode: mode, Owner: usr.Username, Group: grp.Name}
+	}
+	want := node("", 0750)
+	file := node("file", 0644)
+	file.Type = FSTypeFile
+	want.Children = []FS{node("a", 0700), node("c", 0555), file}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("inspect = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckFS(t *testing.T) {
+	for _, tc := range []struct {
+		fs    FS
+		valid bool
+	}{
+		{FS{}, true},
+		{FS{Children: []FS{{Name: "a/b", Children: []FS{{Name: "../c"}}}}}, true},
+		{FS{Name: "root"}, false},
+		{FS{Children: []FS{{Name: ""}}}, false},
+		{FS{Children: []FS{{Name: "a", Children: []FS{{Name: "../../etc"}}}}}, false},
+		{FS{Children: []FS{{Name: "README.txt", Type: FSTypeFile, Content: "hi"}}}, true},
+		{FS{Children: []FS{{Name: "a", Content: "hi"}}}, false},
+		{FS{Children: []FS{{Name: "a", Type: "link"}}}, false},
+		{FS{Children: []FS{{Name: "../README.txt", Type: FSTypeFile}}}, false},
+		{FS{Children: []FS{{Name: "a", Type: FSTypeFile, Children: []FS{{Name: "b"}}}}}, false},
+		{FS{Children: []FS{{Name: "a", Type: FSTypeFile, Content: strings.Repeat("a", maxFileContent+1)}}}, false},
+		{FS{Children: []FS{{Name: "a", Type: FSTypeFile, ContentTemplate: "{{.Username"}}}, false},
+		{FS{Type: FSTypeFile}, false},
+	} {
+		if err := checkFS(tc.fs); (err == nil) != tc.valid {
+			t.Errorf("checkFS(%+v) = %v, want valid = %t", tc.fs, err, tc.valid)
+		}
+	}
+}
+
+func TestDeclaredPaths(t *testing.T) {
+	got, parents := declaredPaths(FS{Children: []FS{
+		{Name: "a/b", Children: []FS{{Name: "../c"}}},
+		{Name: "d", Children: []FS{{Name: "README.txt", Type: FSTypeFile}}},
+	}})
+	want := map[string]bool{"a": true, "a/b": true, "a/c": true, "d": true, "d/README.txt": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("declaredPaths = %v, want %v", got, want)
+	}
+	want = map[string]bool{".": true, "a": true}
+	if !reflect.DeepEqual(parents, want) {
+		t.Errorf("declaredPaths parents = %v, want %v", parents, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &Mgr{root: dir}
+	u := &User{Username: "test"}
+	root := m.home(u)
+	if err = mkfs(root, FS{Children: []FS{{Name: "a"}, {Name: "b"}, {Name: "write/photos"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "write", "photos", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := FS{Children: []FS{{Name: "write"}}}
+
+	actions, err := m.prunefs(u, fs, &FSOptions{Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions[0].Action != FSActionRemove {
+		t.Fatalf("prunefs = %v, want two removals", actions)
+	}
+
+	// files created after planning are not removed with the directory.
+	if err = ioutil.WriteFile(filepath.Join(root, "a", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = applyfs(actions); err == nil {
+		t.Fatal("applyfs removed a non-empty directory")
+	}
+	if _, err = os.Stat(filepath.Join(root, "a", "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	if actions, err = m.prunefs(u, fs, &FSOptions{Prune: true, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = applyfs(actions); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "a")); !os.IsNotExist(err) {
+		t.Errorf("forced removal kept the directory: %v", err)
+	}
+
+	// directories created by users in declared ones are never pruned.
+	if _, err = os.Stat(filepath.Join(root, "write", "photos", "file")); err != nil {
+		t.Errorf("forced removal deleted a user's directory: %v", err)
+	}
+}
+
 func testDir(t *testing.T, root, name string, mode os.FileMode) {
 	path := filepath.Join(root, name)
 	stat, err := os.Lstat(path)
@@ -0,0 +1,152 @@
+package mgr
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrLockTimeout is returned when the cluster-wide lock cannot be
+// acquired in time, it's safe to retry the operation later.
+var ErrLockTimeout = &Error{Code: CodeUnavailable, Message: "timed out waiting for other operations to finish"}
+
+// defaultLockTimeout is used unless WithLockTimeout is given.
+const defaultLockTimeout = 30 * time.Second
+
+// WithLockTimeout limits how long operations wait for the cluster-wide lock,
+// contexts with earlier deadlines still stop waiting earlier.
+func WithLockTimeout(d time.Duration) Option {
+	return func(m *Mgr) {
+		m.lockTimeout = d
+	}
+}
+
+// lockKey hashes a name into an advisory lock key.
+func lockKey(name string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int32(h.Sum32())
+}
+
+// pwdfileLockKey is the second key of the lock serializing pwdfile writes,
+// keys of names' locks are hashes of the names that are never zero.
+const pwdfileLockKey = 0
+
+// lockNames acquires the cluster-wide locks serializing mutations of the
+// users or tenants with the names, they share one namespace since both are
+// directories in the root, managers using the same pwdfile path share locks.
+// Locks are taken in order of their keys, so callers never deadlock.
+func (m *Mgr) lockNames(ctx context.Context, names ...string) (func(), error) {
+	keys := make([]int32, 0, len(names))
+	for _, name := range names {
+		key := lockKey(name)
+		if key == pwdfileLockKey {
+			key++
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		f, err := m.advisoryLock(ctx, key)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		unlocks = append(unlocks, f)
+	}
+	return unlock, nil
+}
+
+// lockPwdfile acquires the cluster-wide lock serializing pwdfile writes.
+func (m *Mgr) lockPwdfile(ctx context.Context) (func(), error) {
+	return m.advisoryLock(ctx, pwdfileLockKey)
+}
+
+// advisoryLock acquires a postgres session-level advisory lock keyed with
+// the pwdfile and the given key, waiting until ctx is done or the lock
+// timeout elapses, the returned function releases it. The lock holds a
+// database connection, that's why it's polled instead of blocking on it.
+func (m *Mgr) advisoryLock(ctx context.Context, key int32) (func(), error) {
+	n := time.Now()
+	lctx, cancel := context.WithTimeout(ctx, m.lockTimeout)
+	defer cancel()
+
+	conn, err := m.db.Conn(lctx)
+	if err != nil {
+		return nil, lockError(ctx, lctx, err)
+	}
+	for delay := 10 * time.Millisecond; ; {
+		var ok bool
+		if err = conn.QueryRowContext(lctx, `SELECT pg_try_advisory_lock($1, $2)`,
+			m.lockKey, key).Scan(&ok); err != nil {
+			conn.Close()
+			return nil, lockError(ctx, lctx, err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-lctx.Done():
+			conn.Close()
+			return nil, lockError(ctx, lctx, lctx.Err())
+		case <-time.After(delay):
+		}
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+	m.stats.observeLockWait(time.Since(n))
+
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1, $2)`,
+			m.lockKey, key); err != nil {
+			fmt.Fprintf(os.Stderr, "mgr error: %v\n", err)
+
+			// the connection cannot be returned to the pool
+			// holding the lock, closing it releases the lock.
+			_ = conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+		}
+		conn.Close()
+	}, nil
+}
+
+// lockError distinguishes running out of time waiting for
+// the lock from the caller giving up and other errors.
+func lockError(ctx, lctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if lctx.Err() != nil {
+		return ErrLockTimeout
+	}
+	return err
+}
+
+// pwdfileKey returns the first key of all the manager's locks,
+// so managers of different pwdfiles don't block each other.
+func pwdfileKey(pwdfile string) (int32, error) {
+	path, err := filepath.Abs(pwdfile)
+	if err != nil {
+		return 0, err
+	}
+	return lockKey(path), nil
+}
@@ -3,16 +3,17 @@ package mgr
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/amenzhinsky/vsftpdmgr/crypt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // User represents a vsftpd virtual user.
@@ -20,31 +21,164 @@ type User struct {
 	Username string `json:"username"`
 	Password string `json:"password,omitempty"`
 
+	// Tenant the user belongs to, blank for users outside of tenants.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Disabled users are kept in the database but not written to
+	// the pwdfile, so they cannot log in until enabled back.
+	Disabled bool `json:"disabled"`
+
+	// Settings are vsftpd configuration options overridden for the user,
+	// they're written to the user config dir when it's configured.
+	Settings map[string]string `json:"settings,omitempty"`
+
+	// FS is stored along with the user, so it can be applied again,
 	// we use pointer here to hide the attribute when marshalling the structure.
+	// When Template is set it only overrides the template's tree.
 	FS *FS `json:"fs,omitempty"`
+
+	// Template is the name of the template the user's fs is based on.
+	Template string `json:"template,omitempty"`
 }
 
 // Mgr is vsftpd users management entity.
 type Mgr struct {
-	mu      sync.Mutex
-	db      *sql.DB
-	root    string
-	pwdfile string
+	mu         sync.Mutex
+	stats      stats
+	db         *sql.DB
+	dbURL      string
+	instance   string
+	lockKey    int32
+	root       string
+	pwdfile    string
+	archiveDir string
+
+	userConfigDir string
+	lockTimeout   time.Duration
+}
+
+// Option is a Mgr configuration option.
+type Option func(m *Mgr)
+
+// WithArchiveDir makes Delete pack users' local roots into tarballs
+// stored in dir instead of removing them, so they can be brought
+// back later with Restore.
+func WithArchiveDir(dir string) Option {
+	return func(m *Mgr) {
+		m.archiveDir = dir
+	}
+}
+
+// WithUserConfigDir makes the manager maintain per-user vsftpd
+// configuration files containing users' settings in dir,
+// it should be the same as user_config_dir in vsftpd.conf.
+func WithUserConfigDir(dir string) Option {
+	return func(m *Mgr) {
+		m.userConfigDir = dir
+	}
+}
+
+// schema is applied every time a manager is created,
+// so every statement has to be idempotent.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		username VARCHAR(32) NOT NULL PRIMARY KEY,
+		password VARCHAR(34) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS archives (
+		id         SERIAL       NOT NULL PRIMARY KEY,
+		username   VARCHAR(32)  NOT NULL,
+		password   VARCHAR(34)  NOT NULL,
+		path       TEXT         NOT NULL,
+		created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS archives_username_idx ON archives (username)`,
+	`ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS settings JSONB NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE archives
+		ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE,
+		ADD COLUMN IF NOT EXISTS settings JSONB NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS tokens (
+		id           SERIAL       NOT NULL PRIMARY KEY,
+		label        VARCHAR(64)  NOT NULL UNIQUE,
+		hash         CHAR(64)     NOT NULL UNIQUE,
+		created_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+		last_used_at TIMESTAMPTZ
+	)`,
+	// tokens created before roles were introduced keep full access.
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'admin'`,
+	`CREATE TABLE IF NOT EXISTS tenants (
+		name       VARCHAR(32)  NOT NULL PRIMARY KEY,
+		created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant VARCHAR(32) REFERENCES tenants (name)`,
+	`CREATE INDEX IF NOT EXISTS users_tenant_idx ON users (tenant)`,
+	`ALTER TABLE archives ADD COLUMN IF NOT EXISTS tenant VARCHAR(32)`,
+	`ALTER TABLE tokens ADD COLUMN IF NOT EXISTS tenant VARCHAR(32) REFERENCES tenants (name) ON DELETE CASCADE`,
+	`CREATE TABLE IF NOT EXISTS audit (
+		id         BIGSERIAL    NOT NULL PRIMARY KEY,
+		created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+		actor      TEXT         NOT NULL,
+		addr       TEXT         NOT NULL,
+		action     VARCHAR(16)  NOT NULL,
+		username   VARCHAR(32)  NOT NULL,
+		tenant     VARCHAR(32),
+		changes    JSONB        NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_username_idx ON audit (username)`,
+	`CREATE INDEX IF NOT EXISTS audit_created_at_idx ON audit (created_at)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id         SERIAL       NOT NULL PRIMARY KEY,
+		url        TEXT         NOT NULL UNIQUE,
+		events     TEXT[]       NOT NULL DEFAULT '{}',
+		secret     TEXT         NOT NULL,
+		created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id              BIGSERIAL    NOT NULL PRIMARY KEY,
+		webhook_id      INTEGER      NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event           VARCHAR(32)  NOT NULL,
+		payload         JSONB        NOT NULL,
+		attempts        INTEGER      NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ  DEFAULT NOW(),
+		last_error      TEXT,
+		created_at      TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_next_attempt_at_idx ON outbox (next_attempt_at)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS fs JSONB`,
+	`ALTER TABLE archives ADD COLUMN IF NOT EXISTS fs JSONB`,
+	`CREATE TABLE IF NOT EXISTS templates (
+		name       VARCHAR(32)  NOT NULL PRIMARY KEY,
+		fs         JSONB        NOT NULL,
+		created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS template VARCHAR(32) REFERENCES templates (name)`,
+	`ALTER TABLE archives ADD COLUMN IF NOT EXISTS template VARCHAR(32)`,
 }
 
 // New creates new Mgr.
-func New(root, pwdfile, databaseURL string) (*Mgr, error) {
+func New(root, pwdfile, databaseURL string, opts ...Option) (*Mgr, error) {
 	db, err := sql.Open("postgres", databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		username VARCHAR(32) NOT NULL PRIMARY KEY,
-		password VARCHAR(34) NOT NULL
-	)`); err != nil {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	instance, err := newInstanceID()
+	if err != nil {
 		return nil, err
 	}
+	m := &Mgr{db: db, dbURL: databaseURL, instance: instance, lockTimeout: defaultLockTimeout}
+	for _, opt := range opts {
+		opt(m)
+	}
 
 	// for convenience
 	root, err = filepath.Abs(root)
@@ -69,96 +203,803 @@ func New(root, pwdfile, databaseURL string) (*Mgr, error) {
 	}
 	f.Close()
 
-	return &Mgr{pwdfile: pwdfile, root: root, db: db}, nil
+	if m.archiveDir != "" {
+		if m.archiveDir, err = filepath.Abs(m.archiveDir); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(m.archiveDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.userConfigDir != "" {
+		if m.userConfigDir, err = filepath.Abs(m.userConfigDir); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(m.userConfigDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	m.root = root
+	m.pwdfile = pwdfile
+	if m.lockKey, err = pwdfileKey(pwdfile); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-// List returns list of all users.
+// List returns list of all users visible in the context's tenant.
 func (m *Mgr) List(ctx context.Context) ([]*User, error) {
-	m.mu.Lock()
+	m.lock()
 	defer m.mu.Unlock()
 
-	users, err := m.list(ctx)
+	users, err := m.list(ctx, TenantFromContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 
-	// hide passwords
+	// hide passwords and fs specs to keep the list compact
 	for _, u := range users {
 		u.Password = ""
+		u.FS = nil
 	}
 	return users, nil
 }
 
-// ErrInvalidUser is returned when user cannot be saved.
-var ErrInvalidUser = errors.New("user is not valid, len(username) < 4 or len(password) < 4")
+// Get returns the named user without its password.
+func (m *Mgr) Get(ctx context.Context, username string) (*User, error) {
+	m.lock()
+	defer m.mu.Unlock()
+
+	u, err := m.get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	u.Password = ""
+	return u, nil
+}
+
+// get retrieves the user visible in the context's tenant from the database.
+func (m *Mgr) get(ctx context.Context, username string) (*User, error) {
+	u, err := scanUser(m.db.QueryRowContext(ctx, `SELECT `+userColumns+`
+		FROM users WHERE username = $1 AND `+tenantFilter, username, TenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	return u, err
+}
+
+// ApplyFS re-creates the user's local root along with the stored fs tree,
+// e.g. after a restore or on a new server, it's safe to call it repeatedly.
+// Directories absent in the spec are removed only when opts ask for it,
+// every action taken or refused is reported.
+func (m *Mgr) ApplyFS(ctx context.Context, username string, opts *FSOptions) ([]*FSAction, error) {
+	if opts.Archive && m.archiveDir == "" {
+		return nil, ErrArchiveDisabled
+	}
+
+	m.lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lockNames(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	u, err := m.get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	actions, err := m.planFS(ctx, u, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return actions, nil
+	}
+	return actions, applyfs(actions)
+}
+
+// PlanFS returns actions saving the user would take on its local root
+// without changing anything, the stored fs tree and template are planned
+// when they're not provided just like Save keeps them.
+func (m *Mgr) PlanFS(ctx context.Context, user *User) ([]*FSAction, error) {
+	if err := validUser(user); err != nil {
+		return nil, err
+	}
+	tenant, err := m.scopeTenant(ctx, user.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock()
+	defer m.mu.Unlock()
+
+	u := &User{Username: user.Username, Tenant: tenant, FS: user.FS, Template: user.Template}
+	stored, err := m.get(ctx, user.Username)
+	switch {
+	case err == nil:
+		if u.FS == nil {
+			u.FS = stored.FS
+		}
+		if u.Template == "" {
+			u.Template = stored.Template
+		}
+	case err != ErrUserNotFound:
+		return nil, err
+	case u.FS == nil && u.Template == "":
+		if _, err = m.GetTemplate(ctx, DefaultTemplate); err == nil {
+			u.Template = DefaultTemplate
+		} else if err != ErrTemplateNotFound {
+			return nil, err
+		}
+	}
+	return m.planFS(ctx, u, &FSOptions{})
+}
+
+// ErrInvalidUser is returned when user cannot be saved,
+// the invalid attribute is reported in the "field" detail.
+var ErrInvalidUser = &Error{
+	Code:    CodeValidation,
+	Message: "user is not valid, username must be 4 to 32 characters without slashes and colons, password at least 4 characters",
+}
+
+var (
+	errInvalidUsername = ErrInvalidUser.WithDetails(map[string]interface{}{"field": "username"})
+	errInvalidPassword = ErrInvalidUser.WithDetails(map[string]interface{}{"field": "password"})
+	errInvalidTemplate = ErrInvalidUser.WithDetails(map[string]interface{}{"field": "template"})
+)
+
+// validUser checks everything Save can check without touching anything.
+func validUser(user *User) error {
+	if !validUsername(user.Username) {
+		return errInvalidUsername
+	}
+	if len(user.Password) < 4 {
+		return errInvalidPassword
+	}
+	if err := validSettings(user.Settings); err != nil {
+		return err
+	}
+	if user.Template != "" && !validUsername(user.Template) {
+		return errInvalidTemplate
+	}
+	if user.FS != nil {
+		return checkFS(*user.FS)
+	}
+	return nil
+}
+
+// validUsername reports whether the name can be used both as
+// a pwdfile login and as a directory name inside of the root.
+func validUsername(name string) bool {
+	return len(name) >= 4 && len(name) <= 32 && !strings.ContainsAny(name, "/:\n")
+}
 
 // Save saves user to the database or update it's password if
-// it already exists.
-func (m *Mgr) Save(ctx context.Context, user *User) error {
-	m.mu.Lock()
+// it already exists, created reports whether the user is new.
+// The disabled flag and settings are taken from user only when fields
+// include FieldDisabled and FieldSettings, otherwise existing users keep
+// the stored ones and new users are enabled and have no settings.
+func (m *Mgr) Save(ctx context.Context, user *User, fields Field) (created bool, err error) {
+	m.lock()
 	defer m.mu.Unlock()
 
-	if len(user.Username) < 4 || len(user.Password) < 4 {
-		return ErrInvalidUser
+	if err = validUser(user); err != nil {
+		return false, err
+	}
+
+	// nil values are passed as NULL meaning the stored values are kept.
+	var disabled, settings interface{}
+	if fields&FieldDisabled != 0 {
+		disabled = user.Disabled
+	}
+	if fields&FieldSettings != 0 {
+		if settings, err = marshalSettings(user.Settings); err != nil {
+			return false, err
+		}
+	}
+	fs, err := marshalFS(user.FS)
+	if err != nil {
+		return false, err
+	}
+	tenant, err := m.scopeTenant(ctx, user.Tenant)
+	if err != nil {
+		return false, err
 	}
 
 	// encrypt password
 	password, err := crypt.MD5(user.Password)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	unlock, err := m.lockNames(ctx, user.Username)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// the row is locked to find out whether the user gets disabled.
+	var wasDisabled bool
+	err = tx.QueryRowContext(ctx, `SELECT disabled FROM users WHERE username = $1 FOR UPDATE`,
+		user.Username).Scan(&wasDisabled)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	// upsert record on username conflict, xmax of a freshly inserted row
+	// version is always zero, users of other tenants are never updated and
+	// users outside of tenants cannot take directories of tenants,
+	// the stored fs and template are kept when they're not provided
+	// and new users without both are based on the default template.
+	u := &User{Username: user.Username, Tenant: tenant}
+	var storedSettings, storedFS []byte
+	err = tx.QueryRowContext(ctx, `INSERT INTO users (username, password, disabled, settings, tenant, fs, template)
+		SELECT $1::VARCHAR, $2::VARCHAR, COALESCE($3::BOOLEAN, FALSE), COALESCE($4::JSONB, '{}'),
+			NULLIF($5::VARCHAR, ''), $6::JSONB,
+			CASE WHEN $7 <> '' THEN $7::VARCHAR
+				WHEN $6 IS NULL THEN (SELECT name FROM templates WHERE name = $8) END
+		WHERE $5 <> '' OR NOT EXISTS (SELECT 1 FROM tenants WHERE name = $1)
+		ON CONFLICT (username) DO UPDATE SET password = $2,
+			disabled = COALESCE($3, users.disabled), settings = COALESCE($4, users.settings),
+			fs = COALESCE($6, users.fs), template = COALESCE(NULLIF($7, ''), users.template)
+		WHERE users.tenant IS NOT DISTINCT FROM NULLIF($5, '')
+		RETURNING xmax = 0, disabled, settings, fs, COALESCE(template, '')`,
+		user.Username, password, disabled, settings, tenant, fs, user.Template, DefaultTemplate).Scan(
+		&created, &u.Disabled, &storedSettings, &storedFS, &u.Template)
+	if err == sql.ErrNoRows {
+		return false, ErrUserExists
+	} else if err != nil {
+		if isTemplateViolation(err) {
+			return false, ErrTemplateNotFound
+		}
+		return false, err
+	}
+
+	if err = json.Unmarshal(storedSettings, &u.Settings); err != nil {
+		return false, err
+	}
+	if len(u.Settings) == 0 {
+		u.Settings = nil
+	}
+	if u.FS, err = unmarshalFS(storedFS); err != nil {
+		return false, err
+	}
+	action := updateAction(wasDisabled, u.Disabled)
+	changes := userChanges(user, FieldPassword|FieldFS|fields&(FieldDisabled|FieldSettings))
+	if created {
+		action = ActionCreate
+		changes = userChanges(u, FieldPassword|FieldDisabled|FieldSettings|FieldFS)
+	}
+	if user.Template != "" || created && u.Template != "" {
+		changes["template"] = u.Template
+	}
+	if err = m.audit(ctx, tx, action, u, changes); err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
 	}
 
 	// create user's local root
-	err = os.MkdirAll(filepath.Join(m.root, user.Username), 0755)
+	root := m.home(u)
+	err = os.MkdirAll(root, 0755)
 	if err != nil && !os.IsExist(err) {
+		return created, err
+	}
+
+	if err = m.sync(ctx); err != nil {
+		return created, err
+	}
+	if err = m.writeUserConfig(u); err != nil {
+		return created, err
+	}
+
+	// TODO: it's not consistent, user can be created or updated successfully
+	// but when the fs creation fails the func returns an error.
+	return created, m.applyFS(ctx, u)
+}
+
+// Field is a set of user attributes that Update changes.
+type Field uint
+
+// Fields of the User structure that can be updated independently.
+const (
+	FieldPassword Field = 1 << iota
+	FieldFS
+	FieldSettings
+	FieldDisabled
+	FieldTemplate
+	FieldUsername
+)
+
+// Update changes only the given fields of an existing user
+// taking their values from user, the rest of them stay intact.
+// FieldUsername renames the user to user.Username in the same
+// transaction, so either all the fields are changed or none.
+func (m *Mgr) Update(ctx context.Context, username string, user *User, fields Field) error {
+	m.lock()
+	defer m.mu.Unlock()
+
+	names := []string{username}
+	if fields&FieldUsername != 0 && user.Username != username {
+		if !validUsername(user.Username) {
+			return errInvalidUsername
+		}
+		names = append(names, user.Username)
+	}
+	unlock, err := m.lockNames(ctx, names...)
+	if err != nil {
 		return err
 	}
+	defer unlock()
+	return m.update(ctx, username, user, fields)
+}
+
+// Patch is Update with the new values computed by patch from the current
+// state of the user, which is read holding the user's lock, so concurrent
+// patches of different attributes don't overwrite each other's changes.
+func (m *Mgr) Patch(ctx context.Context, username string, fields Field, patch func(u *User) (*User, error)) error {
+	m.lock()
+	defer m.mu.Unlock()
+
+	// the new name of a renamed user is known only after patching,
+	// the locks are then taken again in order with the new name.
+	names := []string{username}
+	for {
+		unlock, err := m.lockNames(ctx, names...)
+		if err != nil {
+			return err
+		}
+		u, err := m.get(ctx, username)
+		if err != nil {
+			unlock()
+			return err
+		}
+		u.Password = ""
+		if u, err = patch(u); err != nil {
+			unlock()
+			return err
+		}
+		if fields&FieldUsername != 0 && u.Username != username &&
+			(len(names) == 1 || names[1] != u.Username) {
+			unlock()
+			if !validUsername(u.Username) {
+				return errInvalidUsername
+			}
+			names = []string{username, u.Username}
+			continue
+		}
+		err = m.update(ctx, username, u, fields)
+		unlock()
+		return err
+	}
+}
+
+// update is Update called with the locks of the user's names held.
+func (m *Mgr) update(ctx context.Context, username string, user *User, fields Field) (err error) {
+	var sets []string
+	args := []interface{}{username}
+	set := func(column string, v interface{}) {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
 
-	// upsert record on username conflict
-	_, err = m.db.ExecContext(ctx, `INSERT INTO users (username, password) VALUES ($1, $2)
-		ON CONFLICT (username) DO UPDATE SET password = $2`, user.Username, password)
+	rename := fields&FieldUsername != 0 && user.Username != username
+	if rename && !validUsername(user.Username) {
+		return errInvalidUsername
+	}
+	if fields&FieldPassword != 0 {
+		if len(user.Password) < 4 {
+			return errInvalidPassword
+		}
+		password, err := crypt.MD5(user.Password)
+		if err != nil {
+			return err
+		}
+		set("password", password)
+	}
+	if fields&FieldSettings != 0 {
+		if err := validSettings(user.Settings); err != nil {
+			return err
+		}
+		settings, err := marshalSettings(user.Settings)
+		if err != nil {
+			return err
+		}
+		set("settings", settings)
+	}
+	if fields&FieldDisabled != 0 {
+		set("disabled", user.Disabled)
+	}
+	if fields&FieldFS != 0 {
+		if user.FS != nil {
+			if err := checkFS(*user.FS); err != nil {
+				return err
+			}
+		}
+		fs, err := marshalFS(user.FS)
+		if err != nil {
+			return err
+		}
+		set("fs", fs)
+	}
+	if fields&FieldTemplate != 0 {
+		if user.Template != "" && !validUsername(user.Template) {
+			return errInvalidTemplate
+		}
+		var template interface{}
+		if user.Template != "" {
+			template = user.Template
+		}
+		set("template", template)
+	}
+
+	// updating nothing is still expected to fail for missing users.
+	args = append(args, TenantFromContext(ctx))
+	where := fmt.Sprintf(` WHERE username = $1 AND `+tenantFilterN, len(args), len(args))
+	query := `SELECT ` + userColumns + ` FROM users` + where
+	if len(sets) != 0 {
+		query = `UPDATE users SET ` + strings.Join(sets, ", ") + where + ` RETURNING ` + userColumns
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	if err = m.sync(ctx); err != nil {
+	var wasDisabled bool
+	if fields&FieldDisabled != 0 {
+		err = tx.QueryRowContext(ctx, `SELECT disabled FROM users WHERE username = $1 FOR UPDATE`,
+			username).Scan(&wasDisabled)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	// the rest of the fields are updated by the new username.
+	if rename {
+		if _, err = m.rename(ctx, tx, username, user.Username); err != nil {
+			return err
+		}
+		args[0] = user.Username
+	}
+
+	u, err := scanUser(tx.QueryRowContext(ctx, query, args...))
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		if isTemplateViolation(err) {
+			return ErrTemplateNotFound
+		}
+		return err
+	}
+	if fields&^FieldUsername != 0 {
+		action := ActionUpdate
+		if fields&FieldDisabled != 0 {
+			action = updateAction(wasDisabled, u.Disabled)
+		}
+		if err = m.audit(ctx, tx, action, u, userChanges(user, fields)); err != nil {
+			return err
+		}
+	}
+	if rename {
+		err = m.commitRename(ctx, tx, username, u)
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	if fields&(FieldPassword|FieldDisabled) != 0 {
+		if err = m.sync(ctx); err != nil {
+			return err
+		}
+	}
+	if fields&FieldSettings != 0 {
+		if err = m.writeUserConfig(u); err != nil {
+			return err
+		}
+	}
+	if fields&(FieldFS|FieldTemplate) != 0 {
+		return m.applyFS(ctx, u)
+	}
+	return nil
+}
+
+// Delete deletes a virtual user, its local root is archived
+// beforehand when the manager is created WithArchiveDir.
+func (m *Mgr) Delete(ctx context.Context, user *User) (err error) {
+	m.lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lockNames(ctx, user.Username)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	root := filepath.Join(m.root, user.Username)
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	fs := FS{}
-	if user.FS != nil {
-		// we copy the FS structure here because
-		// it's modified when pass it to mkfs.
-		fs = *user.FS
+	u, err := scanUser(tx.QueryRowContext(ctx, `DELETE FROM users WHERE username = $1 AND `+tenantFilter+`
+		RETURNING `+userColumns, user.Username, TenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
 	}
 
-	// TODO: it's not consistent, user can be created or updated successfully
-	// but when the fs creation fails the func returns an error.
-	return mkfs(root, fs, true)
+	if err = m.audit(ctx, tx, ActionDelete, u, nil); err != nil {
+		return err
+	}
+
+	var path string
+	if m.archiveDir != "" {
+		if path, err = m.archive(ctx, tx, u); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		if path != "" {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	if err = os.RemoveAll(m.home(u)); err != nil {
+		return err
+	}
+	if err = m.removeUserConfig(u.Username); err != nil {
+		return err
+	}
+	return m.sync(ctx)
+}
+
+// archive packs the user's local root and stores it along with the
+// password hash and settings in the archives table, returns the tarball path.
+func (m *Mgr) archive(ctx context.Context, tx *sql.Tx, u *User) (string, error) {
+	settings, err := marshalSettings(u.Settings)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(m.archiveDir, fmt.Sprintf("%s-%d.tar.gz", u.Username, time.Now().UnixNano()))
+	if err = writeArchive(m.home(u), path); err != nil {
+		return "", err
+	}
+	fs, err := marshalFS(u.FS)
+	if err != nil {
+		return "", err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO archives (username, password, disabled, settings, tenant, fs, template, path)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), $8)`,
+		u.Username, u.Password, u.Disabled, settings, u.Tenant, fs, u.Template, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+var (
+	// ErrUserExists is returned when a user cannot be restored
+	// because the username or its local root is already taken.
+	ErrUserExists = &Error{Code: CodeConflict, Message: "user already exists"}
+
+	// ErrArchiveNotFound is returned when there is no archive for a user.
+	ErrArchiveNotFound = &Error{Code: CodeNotFound, Message: "archive not found"}
+)
+
+// Restore recreates the most recently deleted user with the given username
+// from the archive, including its password and local root content.
+func (m *Mgr) Restore(ctx context.Context, username string) (err error) {
+	m.lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lockNames(ctx, username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var id int
+	var path string
+	err = m.db.QueryRowContext(ctx, `SELECT id, path FROM archives
+		WHERE username = $1 AND `+tenantFilter+` ORDER BY created_at DESC, id DESC LIMIT 1`,
+		username, TenantFromContext(ctx)).Scan(&id, &path)
+	if err == sql.ErrNoRows {
+		return ErrArchiveNotFound
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// the template may be deleted since the user is archived.
+	u, err := scanUser(tx.QueryRowContext(ctx, `INSERT INTO users (username, password, disabled, settings, tenant, fs, template)
+		SELECT username, password, disabled, settings, tenant, fs,
+			(SELECT name FROM templates WHERE name = archives.template)
+		FROM archives WHERE id = $1
+		ON CONFLICT (username) DO NOTHING
+		RETURNING `+userColumns, id))
+	if err == sql.ErrNoRows {
+		return ErrUserExists
+	} else if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "foreign_key_violation" {
+			return ErrTenantNotFound
+		}
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM archives WHERE id = $1`, id); err != nil {
+		return err
+	}
+	if err = m.audit(ctx, tx, ActionRestore, u, nil); err != nil {
+		return err
+	}
+
+	root := m.home(u)
+	if err = extractArchive(path, root); err != nil {
+		if os.IsExist(err) {
+			return ErrUserExists
+		}
+		os.RemoveAll(root)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+
+	// the archive is not needed anymore, failing to
+	// remove it doesn't affect the restored user.
+	if rerr := os.Remove(path); rerr != nil {
+		fmt.Fprintf(os.Stderr, "mgr error: %v\n", rerr)
+	}
+	if err = m.writeUserConfig(u); err != nil {
+		return err
+	}
+	return m.sync(ctx)
 }
 
-// Delete deletes a virtual user.
-func (m *Mgr) Delete(ctx context.Context, user *User) error {
-	m.mu.Lock()
+// ErrUserNotFound is returned when the requested user doesn't exist.
+var ErrUserNotFound = &Error{Code: CodeNotFound, Message: "user not found"}
+
+// Rename changes username of an existing user moving its local root
+// along, the password and the directory content are preserved.
+func (m *Mgr) Rename(ctx context.Context, username, newUsername string) (err error) {
+	m.lock()
 	defer m.mu.Unlock()
 
-	if err := os.RemoveAll(filepath.Join(m.root, user.Username)); err != nil {
+	if !validUsername(newUsername) {
+		return errInvalidUsername
+	}
+
+	unlock, err := m.lockNames(ctx, username, newUsername)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
 
-	_, err := m.db.ExecContext(ctx, `DELETE FROM users WHERE username = $1`, user.Username)
+	u, err := m.rename(ctx, tx, username, newUsername)
 	if err != nil {
 		return err
 	}
+	if username == newUsername {
+		return tx.Commit()
+	}
+	return m.commitRename(ctx, tx, username, u)
+}
+
+// rename changes username of the user in the transaction,
+// the local root is moved later by commitRename.
+func (m *Mgr) rename(ctx context.Context, tx *sql.Tx, username, newUsername string) (*User, error) {
+	// users outside of tenants cannot take directories of tenants.
+	u, err := scanUser(tx.QueryRowContext(ctx, `UPDATE users SET username = $3
+		WHERE username = $1 AND `+tenantFilter+`
+		AND (tenant IS NOT NULL OR NOT EXISTS (SELECT 1 FROM tenants WHERE name = $3))
+		RETURNING `+userColumns, username, TenantFromContext(ctx), newUsername))
+	if err == sql.ErrNoRows {
+		if _, gerr := m.get(ctx, username); gerr != nil {
+			return nil, gerr
+		}
+		return nil, ErrUserExists
+	} else if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+	if username == newUsername {
+		return u, nil
+	}
+	if err = m.audit(ctx, tx, ActionRename, &User{Username: username, Tenant: u.Tenant},
+		map[string]interface{}{"username": newUsername}); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// commitRename moves the local root of the user renamed in the transaction
+// and commits it, the move is reverted when the transaction cannot be
+// committed, then the user config and the pwdfile are rewritten.
+func (m *Mgr) commitRename(ctx context.Context, tx *sql.Tx, username string, u *User) error {
+	root := m.home(&User{Username: username, Tenant: u.Tenant})
+	newRoot := m.home(u)
+	if _, err := os.Lstat(newRoot); err == nil {
+		return ErrUserExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// a missing local root is recreated by the next Save.
+	moved := true
+	if err := os.Rename(root, newRoot); os.IsNotExist(err) {
+		moved = false
+	} else if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		if moved {
+			_ = os.Rename(newRoot, root) // try to revert changes
+		}
+		return err
+	}
+	if err := m.removeUserConfig(username); err != nil {
+		return err
+	}
+	if err := m.writeUserConfig(u); err != nil {
+		return err
+	}
 	return m.sync(ctx)
 }
 
 // Sync synchronizes the pwdfile with the database data.
 // Useful in case the pwdfile is lost.
 func (m *Mgr) Sync(ctx context.Context) error {
-	m.mu.Lock()
+	m.lock()
 	defer m.mu.Unlock()
 
 	return m.sync(ctx)
@@ -166,7 +1007,7 @@ func (m *Mgr) Sync(ctx context.Context) error {
 
 // Close shuts down manager.
 func (m *Mgr) Close() error {
-	m.mu.Lock()
+	m.lock()
 	defer m.mu.Unlock()
 
 	if err := m.db.Close(); err != nil {
@@ -175,20 +1016,59 @@ func (m *Mgr) Close() error {
 	return nil
 }
 
-// list retrieves list of users from the database.
-func (m *Mgr) list(ctx context.Context) (users []*User, err error) {
-	rows, err := m.db.QueryContext(ctx, `SELECT username, password FROM users`)
+// userColumns is the list of users table columns scanUser expects.
+const userColumns = `username, password, COALESCE(tenant, ''), disabled, settings, fs, COALESCE(template, '')`
+
+// tenantFilter restricts a users query to the tenant passed as $2,
+// blank tenant matches all users, tenantFilterN is the same for $N.
+const (
+	tenantFilter  = `($2 = '' OR tenant = $2)`
+	tenantFilterN = `($%d = '' OR tenant = $%d)`
+)
+
+// scanUser scans a users table row selected with userColumns.
+func scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var u User
+	var settings, fs []byte
+	if err := row.Scan(&u.Username, &u.Password, &u.Tenant, &u.Disabled, &settings, &fs, &u.Template); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(settings, &u.Settings); err != nil {
+		return nil, err
+	}
+	if len(u.Settings) == 0 {
+		u.Settings = nil
+	}
+	var err error
+	if u.FS, err = unmarshalFS(fs); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// marshalSettings encodes settings for storing in a JSONB column.
+func marshalSettings(settings map[string]string) ([]byte, error) {
+	if settings == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(settings)
+}
+
+// list retrieves list of users of the tenant from the database,
+// blank tenant means all users regardless of their tenants.
+func (m *Mgr) list(ctx context.Context, tenant string) (users []*User, err error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users WHERE `+tenantFilter, tenant)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var u User
-		if err = rows.Scan(&u.Username, &u.Password); err != nil {
+		var u *User
+		if u, err = scanUser(rows); err != nil {
 			return
 		}
-		users = append(users, &u)
+		users = append(users, u)
 	}
 	return users, rows.Err()
 }
@@ -198,7 +1078,17 @@ var header = []byte("# This file is managed by vsftpdmgr, all changes will be ov
 
 // sync saves users list from database to the pwdfile.
 func (m *Mgr) sync(ctx context.Context) (err error) {
-	users, err := m.list(ctx)
+	defer func(n time.Time) {
+		m.stats.observeSync(time.Since(n), err)
+	}(time.Now())
+
+	unlock, err := m.lockPwdfile(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	users, err := m.list(ctx, "")
 	if err != nil {
 		return
 	}
@@ -228,20 +1118,9 @@ func (m *Mgr) sync(ctx context.Context) (err error) {
 		}
 	}()
 
-	// sort users alphabetically
-	sort.Slice(users, func(i, j int) bool {
-		return users[i].Username < users[j].Username
-	})
-
-	// write header and content
-	if _, err = t.Write(header); err != nil {
+	if _, err = t.Write(pwdfileContent(users)); err != nil {
 		return
 	}
-	for _, u := range users {
-		if _, err = t.Write([]byte(u.Username + ":" + u.Password + "\n")); err != nil {
-			return
-		}
-	}
 
 	// safely replace the pwdfile with new one
 	oldPath := m.pwdfile + "__old__"
@@ -255,8 +1134,29 @@ func (m *Mgr) sync(ctx context.Context) (err error) {
 	return os.Remove(oldPath)
 }
 
-// Clean delete all records from the users table.
+// pwdfileContent renders the pwdfile, users are sorted
+// alphabetically and the disabled ones are skipped.
+func pwdfileContent(users []*User) []byte {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	b := append([]byte{}, header...)
+	for _, u := range users {
+		if u.Disabled {
+			continue
+		}
+		b = append(b, u.Username+":"+u.Password+"\n"...)
+	}
+	return b
+}
+
+// Clean delete all records from the users, archives, tokens, tenants, audit and webhooks tables.
 func (m *Mgr) Clean() error {
-	_, err := m.db.Exec(`DELETE FROM users`)
-	return err
+	for _, table := range []string{"users", "archives", "tokens", "tenants", "audit", "outbox", "webhooks", "templates"} {
+		if _, err := m.db.Exec(`DELETE FROM ` + table); err != nil {
+			return err
+		}
+	}
+	return nil
 }
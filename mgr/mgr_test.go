@@ -2,12 +2,17 @@ package mgr
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/amenzhinsky/vsftpdmgr/internal/testenv"
 )
 
 func TestCRUD(t *testing.T) {
@@ -66,7 +71,7 @@ func TestCRUD(t *testing.T) {
 			},
 		},
 	}
-	if err := m.Save(context.Background(), u); err != nil {
+	if _, err := m.Save(context.Background(), u, 0); err != nil {
 		t.Fatal(err)
 	}
 	testFileContains(t, pwdfile.Name(), u.Username)
@@ -75,7 +80,7 @@ func TestCRUD(t *testing.T) {
 
 	// update
 	u.Password = "securePassword"
-	if err := m.Save(context.Background(), u); err != nil {
+	if _, err := m.Save(context.Background(), u, 0); err != nil {
 		t.Fatal(err)
 	}
 	testFileContains(t, pwdfile.Name(), u.Username)
@@ -95,6 +100,643 @@ func TestCRUD(t *testing.T) {
 	}
 }
 
+func TestRestore(t *testing.T) {
+	archiveDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDir)
+
+	m, root, pwdfile := newTestMgr(t, WithArchiveDir(archiveDir))
+	u := &User{
+		Username: "test",
+		Password: "insecurePassword",
+		FS: &FS{
+			Mode:     0750,
+			Children: []FS{{Name: "read", Mode: 0555}},
+		},
+	}
+	if _, err := m.Save(context.Background(), u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	testLocalRootDoesntExists(t, root, u.Username)
+
+	if err := m.Restore(context.Background(), u.Username); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, u.Username)
+	testListContains(t, m, u)
+	testDir(t, root, "test", 0750)
+	testDir(t, root, "test/read", 0555)
+
+	// the archive is consumed by the first restore
+	if err := m.Restore(context.Background(), u.Username); err != ErrArchiveNotFound {
+		t.Errorf("Restore error = %v, want %v", err, ErrArchiveNotFound)
+	}
+}
+
+func TestRename(t *testing.T) {
+	m, root, pwdfile := newTestMgr(t)
+	for _, name := range []string{"test", "taken"} {
+		if _, err := m.Save(context.Background(), &User{
+			Username: name,
+			Password: "insecurePassword",
+		}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "test", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Rename(context.Background(), "test", "taken"); err != ErrUserExists {
+		t.Errorf("Rename error = %v, want %v", err, ErrUserExists)
+	}
+	if err := m.Rename(context.Background(), "missing", "renamed"); err != ErrUserNotFound {
+		t.Errorf("Rename error = %v, want %v", err, ErrUserNotFound)
+	}
+
+	// failing updates don't rename users either.
+	if err := m.Update(context.Background(), "test", &User{Username: "renamed", Template: "missing"},
+		FieldUsername|FieldTemplate); err != ErrTemplateNotFound {
+		t.Errorf("Update error = %v, want %v", err, ErrTemplateNotFound)
+	}
+	testFileContains(t, pwdfile, "test:")
+	testLocalRootDoesntExists(t, root, "renamed")
+
+	if err := m.Rename(context.Background(), "test", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, "renamed:")
+	testFileDoesntContain(t, pwdfile, "test:")
+	testLocalRootDoesntExists(t, root, "test")
+	if _, err := os.Lstat(filepath.Join(root, "renamed", "file")); err != nil {
+		t.Errorf("renamed local root content is lost: %v", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	m, _, pwdfile := newTestMgr(t, WithUserConfigDir(configDir))
+	u := &User{Username: "test", Password: "insecurePassword"}
+	if _, err := m.Save(context.Background(), u, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Update(context.Background(), u.Username, &User{
+		Disabled: true,
+		Settings: map[string]string{"write_enable": "YES"},
+	}, FieldDisabled|FieldSettings); err != nil {
+		t.Fatal(err)
+	}
+	testFileDoesntContain(t, pwdfile, u.Username)
+	testFileContains(t, filepath.Join(configDir, u.Username), "write_enable=YES\n")
+
+	got, err := m.Get(context.Background(), u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled || got.Settings["write_enable"] != "YES" {
+		t.Errorf("Get = %+v, want disabled user with settings", got)
+	}
+
+	// saving only the password keeps the rest intact.
+	if _, err = m.Save(context.Background(), &User{Username: u.Username, Password: "newPassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = m.Get(context.Background(), u.Username); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled || got.Settings["write_enable"] != "YES" {
+		t.Errorf("Get = %+v, want disabled user with settings after Save", got)
+	}
+	testFileDoesntContain(t, pwdfile, u.Username)
+
+	if err = m.Update(context.Background(), u.Username, &User{}, FieldDisabled); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, u.Username)
+
+	if err = m.Update(context.Background(), "missing", &User{}, 0); err != ErrUserNotFound {
+		t.Errorf("Update error = %v, want %v", err, ErrUserNotFound)
+	}
+	// patches see changes of each other.
+	for _, k := range []string{"write_enable", "anon_upload_enable"} {
+		k := k
+		if err = m.Patch(context.Background(), u.Username, FieldSettings, func(u *User) (*User, error) {
+			u.Settings[k] = "NO"
+			return u, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err = m.Get(context.Background(), u.Username); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Settings) != 2 || got.Settings["write_enable"] != "NO" {
+		t.Errorf("Get settings = %v, want both patched", got.Settings)
+	}
+	if err = m.Patch(context.Background(), u.Username, FieldUsername, func(u *User) (*User, error) {
+		u.Username = "renamed"
+		return u, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Get(context.Background(), "renamed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	m, root, _ := newTestMgr(t)
+	fs := &FS{Mode: 0750, Children: []FS{{Name: "read", Mode: 0555}}}
+	if _, err := m.Save(context.Background(), &User{
+		Username: "test",
+		Password: "insecurePassword",
+		FS:       fs,
+	}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.FS, fs) {
+		t.Errorf("Get fs = %+v, want %+v", got.FS, fs)
+	}
+	users, err := m.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].FS != nil {
+		t.Errorf("List = %v, want a single user without fs", users)
+	}
+
+	// saving without fs keeps the stored one
+	if _, err = m.Save(context.Background(), &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, "test", "read")); err != nil {
+		t.Fatal(err)
+	}
+	actions, err := m.ApplyFS(context.Background(), "test", &FSOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Action != FSActionCreate || actions[0].Path != "read" {
+		t.Errorf("ApplyFS = %v, want read created", actions)
+	}
+	if _, err = os.Stat(filepath.Join(root, "test", "read")); !os.IsNotExist(err) {
+		t.Errorf("dry run created a directory: %v", err)
+	}
+	if _, err = m.ApplyFS(context.Background(), "test", &FSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	testDir(t, root, "test", 0750)
+	testDir(t, root, "test/read", 0555)
+
+	// undeclared directories are pruned only when asked, non-empty ones only when forced
+	for _, dir := range []string{"empty", "full/nested"} {
+		if err = os.MkdirAll(filepath.Join(root, "test", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if actions, err = m.ApplyFS(context.Background(), "test", &FSOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 ||
+		actions[0].Action != FSActionRemove || actions[0].Path != "empty" ||
+		actions[1].Action != FSActionSkip || actions[1].Path != "full" {
+		t.Errorf("ApplyFS = %v, want empty removed and full skipped", actions)
+	}
+	if actions, err = m.ApplyFS(context.Background(), "test", &FSOptions{Prune: true, Force: true}); err != nil {
+		t.Fatal(err)
+	} else if len(actions) != 1 || actions[0].Action != FSActionRemove || actions[0].Path != "full" {
+		t.Errorf("ApplyFS = %v, want full removed", actions)
+	}
+	testDir(t, root, "test/read", 0555)
+	if _, err = os.Stat(filepath.Join(root, "test", "full")); !os.IsNotExist(err) {
+		t.Errorf("undeclared directory is not removed: %v", err)
+	}
+	if _, err = m.ApplyFS(context.Background(), "test", &FSOptions{Prune: true, Archive: true}); err != ErrArchiveDisabled {
+		t.Errorf("ApplyFS error = %v, want %v", err, ErrArchiveDisabled)
+	}
+
+	if err = m.Update(context.Background(), "test", &User{
+		FS: &FS{Children: []FS{{Name: "../../etc"}}},
+	}, FieldFS); err == nil {
+		t.Error("Update with fs outside of the root succeeded")
+	}
+	if _, err = m.ApplyFS(context.Background(), "missing", &FSOptions{}); err != ErrUserNotFound {
+		t.Errorf("ApplyFS error = %v, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	m, _, _ := newTestMgr(t)
+	secret, token, err := m.CreateToken(context.Background(), "test", RoleAdmin, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = m.CreateToken(context.Background(), "test", RoleAdmin, ""); err != ErrTokenExists {
+		t.Errorf("CreateToken error = %v, want %v", err, ErrTokenExists)
+	}
+
+	got, err := m.Authenticate(context.Background(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != token.ID || got.LastUsedAt == nil {
+		t.Errorf("Authenticate = %+v, want used token %d", got, token.ID)
+	}
+
+	if err = m.RevokeToken(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Authenticate(context.Background(), secret); err != ErrTokenNotFound {
+		t.Errorf("Authenticate error = %v, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	plain, _, _ := newTestMgr(t)
+	if _, err := plain.CreateTenant(context.Background(), "first"); err != ErrTenantsDisabled {
+		t.Errorf("CreateTenant error = %v, want %v", err, ErrTenantsDisabled)
+	}
+
+	configDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(configDir)
+
+	m, root, pwdfile := newTestMgr(t, WithUserConfigDir(configDir))
+	if _, err := m.CreateTenant(context.Background(), "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateTenant(context.Background(), "first"); err != ErrTenantExists {
+		t.Errorf("CreateTenant error = %v, want %v", err, ErrTenantExists)
+	}
+	if _, err := m.CreateTenant(context.Background(), "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	first := WithTenant(context.Background(), "first")
+	second := WithTenant(context.Background(), "second")
+	if _, err := m.Save(first, &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, "test:")
+	if _, err := os.Lstat(filepath.Join(root, "first", "test")); err != nil {
+		t.Errorf("local root is not in the tenant directory: %v", err)
+	}
+
+	if _, err := m.Save(second, &User{Username: "test", Password: "insecurePassword"}, 0); err != ErrUserExists {
+		t.Errorf("Save error = %v, want %v", err, ErrUserExists)
+	}
+	if _, err := m.Save(second, &User{
+		Username: "other",
+		Password: "insecurePassword",
+		Tenant:   "first",
+	}, 0); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("Save to another tenant error = %v, want %v", err, ErrInvalidTenant)
+	}
+	users, err := m.List(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("List = %v, want no users of another tenant", users)
+	}
+	if err = m.Delete(second, &User{Username: "test"}); err != ErrUserNotFound {
+		t.Errorf("Delete error = %v, want %v", err, ErrUserNotFound)
+	}
+	if err = m.DeleteTenant(context.Background(), "first"); err != ErrTenantNotEmpty {
+		t.Errorf("DeleteTenant error = %v, want %v", err, ErrTenantNotEmpty)
+	}
+
+	if err = m.Delete(first, &User{Username: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.DeleteTenant(context.Background(), "first"); err != nil {
+		t.Fatal(err)
+	}
+	testLocalRootDoesntExists(t, root, "first")
+}
+
+func TestAudit(t *testing.T) {
+	m, _, _ := newTestMgr(t)
+	ctx := WithActor(context.Background(), Actor{Name: "token:test", Addr: "127.0.0.1"})
+	u := &User{Username: "test", Password: "insecurePassword"}
+	if _, err := m.Save(ctx, u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(ctx, u.Username, &User{Password: "newPassword", Disabled: true},
+		FieldPassword|FieldDisabled); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := m.Audit(context.Background(), &AuditFilter{Actor: "token:test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("len(Audit) = %d, want 2", len(entries))
+	}
+	if entries[0].Action != ActionDisable || entries[1].Action != ActionCreate {
+		t.Errorf("Audit actions = %s, %s, want disable, create", entries[0].Action, entries[1].Action)
+	}
+	if entries[0].Addr != "127.0.0.1" || entries[0].Changes["disabled"] != true {
+		t.Errorf("Audit = %+v, want disabled user from 127.0.0.1", entries[0])
+	}
+	for _, e := range entries {
+		if e.Changes["password"] != redacted {
+			t.Errorf("Audit password change = %v, want %q", e.Changes["password"], redacted)
+		}
+	}
+
+	entries, err = m.Audit(context.Background(), &AuditFilter{
+		Username: u.Username,
+		Since:    time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Action != ActionDelete {
+		t.Errorf("Audit = %+v, want the deletion on top", entries)
+	}
+}
+
+func TestReady(t *testing.T) {
+	m, _, pwdfile := newTestMgr(t)
+	if _, err := m.Save(context.Background(), &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Ready(context.Background()); !ok {
+		t.Fatal("Ready = false, want true")
+	}
+
+	if err := ioutil.WriteFile(pwdfile, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks, ok := m.Ready(context.Background())
+	if ok {
+		t.Fatal("Ready = true, want false when pwdfile is out of sync")
+	}
+	for _, c := range checks {
+		if want := c.Name != "pwdfile_in_sync"; c.OK != want {
+			t.Errorf("%s check ok = %t, want %t", c.Name, c.OK, want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	m, root, pwdfile := newTestMgr(t)
+	for _, username := range []string{"changed", "missing", "homeless"} {
+		if _, err := m.Save(context.Background(), &User{Username: username, Password: "insecurePassword"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(root, "homeless")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "orphan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pwdfile, []byte("# comment\nchanged:hash\nhomeless:x\nextra:hash\nbroken\nchanged:other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := m.Diff(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Diff{
+		MissingUsers:       []string{"missing"},
+		ExtraUsers:         []string{"extra"},
+		PasswordMismatches: []string{"changed", "homeless"},
+		MalformedLines:     []int{5},
+		DuplicateLines:     []int{6},
+		OrphanHomes:        []string{"orphan"},
+		MissingHomes:       []string{"homeless"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("Diff = %+v, want %+v", d, want)
+	}
+
+	if err = m.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, "orphan")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(root, "homeless"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = m.Diff(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if !d.Empty() {
+		t.Errorf("Diff = %+v, want no drift after sync", d)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	m, root, pwdfile := newTestMgr(t)
+	if _, err := m.Save(context.Background(), &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pwdfile, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "test")); err != nil {
+		t.Fatal(err)
+	}
+
+	corrections, err := m.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrections) != 2 || corrections[0].Kind != CorrectionPwdfile ||
+		corrections[1].Kind != CorrectionHome {
+		t.Errorf("Reconcile = %v, want pwdfile and home corrections", corrections)
+	}
+	testFileContains(t, pwdfile, "test:")
+	if _, err = os.Stat(filepath.Join(root, "test")); err != nil {
+		t.Errorf("local root is not recreated: %v", err)
+	}
+
+	if corrections, err = m.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(corrections) != 0 {
+		t.Errorf("Reconcile = %v, want no corrections", corrections)
+	}
+
+	// vsftpd matches the first line of a login, so later ones are drift.
+	b, err := ioutil.ReadFile(pwdfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pwdfile, append(b, "test:hash\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if corrections, err = m.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if len(corrections) != 1 || corrections[0].Reason != "duplicate login" {
+		t.Errorf("Reconcile = %v, want duplicate login corrected", corrections)
+	}
+	testFileDoesntContain(t, pwdfile, "test:hash")
+
+	// a broken local root doesn't stop others from being healed.
+	if _, err = m.Save(context.Background(), &User{Username: "broken", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, "broken")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, "broken"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, "test")); err != nil {
+		t.Fatal(err)
+	}
+	corrections, err = m.Reconcile(context.Background())
+	if e, ok := err.(reconcileError); !ok || len(e) != 1 || e["broken"] == nil {
+		t.Errorf("Reconcile error = %v, want an error of broken", err)
+	}
+	if len(corrections) != 1 || corrections[0].Target != "test" {
+		t.Errorf("Reconcile = %v, want test healed", corrections)
+	}
+	if _, err = os.Stat(filepath.Join(root, "test")); err != nil {
+		t.Errorf("local root is not recreated: %v", err)
+	}
+}
+
+func TestApplyChange(t *testing.T) {
+	m, _, _ := newTestMgr(t)
+	remote, root, pwdfile := newTestMgr(t)
+
+	u := &User{Username: "test", Password: "insecurePassword"}
+	if _, err := m.Save(context.Background(), u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.applyChange(context.Background(),
+		`{"instance":"`+m.instance+`","action":"create","username":"test"}`); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, "test:")
+	if _, err := os.Stat(filepath.Join(root, "test")); err != nil {
+		t.Errorf("local root is not created: %v", err)
+	}
+
+	if err := m.Rename(context.Background(), "test", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.applyChange(context.Background(),
+		`{"instance":"`+m.instance+`","action":"rename","username":"test","new_username":"renamed"}`); err != nil {
+		t.Fatal(err)
+	}
+	testFileContains(t, pwdfile, "renamed:")
+	testLocalRootDoesntExists(t, root, "test")
+
+	// renamed twice before the first notification arrives.
+	if err := ioutil.WriteFile(filepath.Join(root, "renamed", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename(context.Background(), "renamed", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rename(context.Background(), "again", "final"); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{
+		`{"instance":"` + m.instance + `","action":"rename","username":"renamed","new_username":"again"}`,
+		`{"instance":"` + m.instance + `","action":"rename","username":"again","new_username":"final"}`,
+	} {
+		if err := remote.applyChange(context.Background(), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "final", "file")); err != nil {
+		t.Errorf("local root content is lost: %v", err)
+	}
+
+	if err := m.Delete(context.Background(), &User{Username: "final"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.applyChange(context.Background(),
+		`{"instance":"`+m.instance+`","action":"delete","username":"final"}`); err != nil {
+		t.Fatal(err)
+	}
+	testFileDoesntContain(t, pwdfile, "final:")
+	testLocalRootDoesntExists(t, root, "final")
+}
+
+func TestClusterLock(t *testing.T) {
+	m, root, pwdfile := newTestMgr(t)
+	other, err := New(root, pwdfile, os.Getenv("TEST_DATABASE_URL"), WithLockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	unlock, err := m.lockPwdfile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Sync(context.Background()); err != ErrLockTimeout {
+		t.Errorf("Sync error = %v, want %v", err, ErrLockTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = other.Sync(ctx); err != context.Canceled {
+		t.Errorf("Sync error = %v, want %v", err, context.Canceled)
+	}
+
+	unlock()
+	if err = other.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// users are locked by their names whoever changes them.
+	if _, err = m.Save(context.Background(), &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if unlock, err = m.lockNames(context.Background(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err = other.Update(context.Background(), "test", &User{Disabled: true}, FieldDisabled); err != ErrLockTimeout {
+		t.Errorf("Update error = %v, want %v", err, ErrLockTimeout)
+	}
+	if err = other.Rename(context.Background(), "other", "test"); err != ErrLockTimeout {
+		t.Errorf("Rename error = %v, want %v", err, ErrLockTimeout)
+	}
+}
+
+// newTestMgr creates a manager in the test environment,
+// all its users are removed when the test finishes.
+func newTestMgr(t *testing.T, opts ...Option) (m *Mgr, root, pwdfile string) {
+	databaseURL, root, pwdfile := testenv.New(t)
+	m, err := New(root, pwdfile, databaseURL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testenv.Cleanup(t, m)
+	return m, root, pwdfile
+}
+
 func testFileContains(t *testing.T, f, s string) {
 	if !fileContains(t, f, s) {
 		t.Errorf("file expected to contain %q but it doesn't", s)
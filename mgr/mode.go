@@ -0,0 +1,155 @@
+package mgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mode is a unix file mode including setuid, setgid and sticky bits,
+// it's encoded in JSON as an octal string like "0755" and decoded from
+// either an octal string, a symbolic one like "u=rwx,g=rx,o=" or a
+// decimal number as it used to be encoded.
+type Mode uint32
+
+// Unix mode bits that os.FileMode keeps elsewhere.
+const (
+	modeSetuid Mode = 04000
+	modeSetgid Mode = 02000
+	modeSticky Mode = 01000
+)
+
+// FileMode converts the mode to the os package representation.
+func (m Mode) FileMode() os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// modeOf returns the unix mode bits of the os package file mode.
+func modeOf(mode os.FileMode) Mode {
+	m := Mode(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= modeSticky
+	}
+	return m
+}
+
+// String returns the mode in octal notation.
+func (m Mode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (m Mode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (m *Mode) UnmarshalJSON(b []byte) error {
+	var n uint32
+	if err := json.Unmarshal(b, &n); err == nil {
+		if Mode(n) > 07777 {
+			return fmt.Errorf("mode %d is out of range", n)
+		}
+		*m = Mode(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("mode must be an octal or symbolic string")
+	}
+	v, err := ParseMode(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// ParseMode parses octal modes like "0755" and symbolic ones like
+// "u=rwx,g=rx,o=" that are applied to an empty mode in order.
+func ParseMode(s string) (Mode, error) {
+	if s != "" && s[0] >= '0' && s[0] <= '7' {
+		n, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || n > 07777 {
+			return 0, fmt.Errorf("mode %q is not a valid octal mode", s)
+		}
+		return Mode(n), nil
+	}
+
+	var m Mode
+	for _, clause := range strings.Split(s, ",") {
+		i := strings.IndexAny(clause, "=+-")
+		if i == -1 {
+			return 0, fmt.Errorf("mode %q is not a valid symbolic mode", s)
+		}
+
+		// who defaults to all, special bits are only set for the
+		// classes they belong to, e.g. "s" with "g" is setgid.
+		var mask Mode
+		who := clause[:i]
+		if who == "" {
+			who = "a"
+		}
+		for _, c := range who {
+			switch c {
+			case 'u':
+				mask |= modeSetuid | 0700
+			case 'g':
+				mask |= modeSetgid | 0070
+			case 'o':
+				mask |= modeSticky | 0007
+			case 'a':
+				mask |= 07777
+			default:
+				return 0, fmt.Errorf("mode %q is not a valid symbolic mode", s)
+			}
+		}
+		var bits Mode
+		for _, c := range clause[i+1:] {
+			switch c {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x':
+				bits |= 0111
+			case 's':
+				bits |= modeSetuid | modeSetgid
+			case 't':
+				bits |= modeSticky
+			default:
+				return 0, fmt.Errorf("mode %q is not a valid symbolic mode", s)
+			}
+		}
+		bits &= mask
+
+		switch clause[i] {
+		case '=':
+			m = m&^mask | bits
+		case '+':
+			m |= bits
+		case '-':
+			m &^= bits
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,71 @@
+package mgr
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	for s, want := range map[string]Mode{
+		"0755":            0755,
+		"755":             0755,
+		"1777":            01777,
+		"u=rwx,g=rx,o=":   0750,
+		"a=rx,u+w":        0755,
+		"=rwx,o-rwx":      0770,
+		"u=rwx,g=rxs,o=t": 03750,
+		"ug=rw":           0660,
+	} {
+		got, err := ParseMode(s)
+		if err != nil {
+			t.Errorf("ParseMode(%q) error: %v", s, err)
+		} else if got != want {
+			t.Errorf("ParseMode(%q) = %s, want %s", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "0800", "17777", "u=rwz", "x=r", "rwx"} {
+		if _, err := ParseMode(s); err == nil {
+			t.Errorf("ParseMode(%q) error is nil", s)
+		}
+	}
+}
+
+func TestModeJSON(t *testing.T) {
+	var fs FS
+	if err := json.Unmarshal([]byte(`{
+		"mode": "0750",
+		"owner": 1001,
+		"group": "ftp",
+		"children": [{"name": "legacy", "mode": 493, "group": 1002}]
+	}`), &fs); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Mode != 0750 || fs.Owner != "1001" || fs.Group != "ftp" ||
+		fs.Children[0].Mode != 0755 || fs.Children[0].Group != "1002" {
+		t.Errorf("Unmarshal = %+v", fs)
+	}
+
+	b, err := json.Marshal(FS{Name: "a", Mode: 02755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"a","mode":"2755","owner":"","group":"","children":null}`; string(b) != want {
+		t.Errorf("Marshal = %s, want %s", b, want)
+	}
+
+	if err = json.Unmarshal([]byte(`{"mode": 8192}`), &fs); err == nil {
+		t.Error("Unmarshal of out of range mode succeeded")
+	}
+}
+
+func TestModeOf(t *testing.T) {
+	for _, m := range []Mode{0755, 01777, 02750, 04711} {
+		if got := modeOf(m.FileMode()); got != m {
+			t.Errorf("modeOf(%s.FileMode()) = %s", m, got)
+		}
+	}
+	if got := Mode(01777).FileMode(); got != os.ModeSticky|0777 {
+		t.Errorf("FileMode = %s, want %s", got, os.ModeSticky|0777)
+	}
+}
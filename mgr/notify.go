@@ -0,0 +1,160 @@
+package mgr
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifyChannel is the postgres channel changes of users are announced on.
+const notifyChannel = "vsftpdmgr_users"
+
+// change is a notification payload, it identifies the affected user only,
+// receivers read the actual state from the database.
+type change struct {
+	// Instance is the ID of the manager that made the change,
+	// so it can skip its own notifications.
+	Instance string `json:"instance"`
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Tenant   string `json:"tenant,omitempty"`
+
+	// NewUsername is set when the user is renamed.
+	NewUsername string `json:"new_username,omitempty"`
+}
+
+// newInstanceID generates a random ID distinguishing managers sharing the database.
+func newInstanceID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// notify announces the change to other managers sharing the database,
+// postgres delivers notifications only when the transaction commits.
+func (m *Mgr) notify(ctx context.Context, tx *sql.Tx, e *AuditEntry) error {
+	c := &change{
+		Instance: m.instance,
+		Action:   e.Action,
+		Username: e.Username,
+		Tenant:   e.Tenant,
+	}
+	if e.Action == ActionRename {
+		c.NewUsername, _ = e.Changes["username"].(string)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, notifyChannel, string(b))
+	return err
+}
+
+// Listen applies changes made by other managers sharing the database to
+// the local pwdfile, local roots and user configs until ctx is done, so
+// every server keeps its own copy without a shared file system. Content
+// of local roots is not replicated, e.g. users restored elsewhere get
+// empty local roots here.
+//
+// Notifications sent while the connection is lost are missed, so the
+// local state is reconciled with the database after every reconnect.
+func (m *Mgr) Listen(ctx context.Context) error {
+	l := pq.NewListener(m.dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mgr error: %v\n", err)
+		}
+	})
+	defer l.Close()
+	if err := l.Listen(notifyChannel); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-l.Notify:
+			var err error
+			if n == nil {
+				_, err = m.Reconcile(ctx)
+			} else {
+				err = m.applyChange(ctx, n.Extra)
+			}
+			if err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "mgr error: %v\n", err)
+			}
+		case <-ticker.C:
+			// detects dead connections that are not closed properly.
+			go l.Ping()
+		}
+	}
+}
+
+// applyChange brings local state of the changed user in line with the database.
+func (m *Mgr) applyChange(ctx context.Context, payload string) error {
+	var c change
+	if err := json.Unmarshal([]byte(payload), &c); err != nil {
+		return err
+	}
+	if c.Instance == m.instance {
+		return nil
+	}
+
+	m.lock()
+	defer m.mu.Unlock()
+
+	// notifications are delivered in the order of commits, so the local
+	// root follows renames even when the user is renamed again or deleted
+	// by the time the notification arrives, the following notifications
+	// move or remove it then. Local roots are removed by deletes only.
+	old := &User{Username: c.Username, Tenant: c.Tenant}
+	username := c.Username
+	if c.Action == ActionRename {
+		username = c.NewUsername
+		renamed := &User{Username: c.NewUsername, Tenant: c.Tenant}
+		if _, err := os.Lstat(m.home(renamed)); os.IsNotExist(err) {
+			if err = os.Rename(m.home(old), m.home(renamed)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		if err := m.removeUserConfig(old.Username); err != nil {
+			return err
+		}
+	}
+
+	// the current state of the user is what's applied.
+	u, err := m.get(ctx, username)
+	switch {
+	case err == ErrUserNotFound && c.Action == ActionDelete:
+		if err = os.RemoveAll(m.home(old)); err != nil {
+			return err
+		}
+		if err = m.removeUserConfig(old.Username); err != nil {
+			return err
+		}
+	case err == ErrUserNotFound:
+	case err != nil:
+		return err
+	default:
+		if err = m.applyFS(ctx, u); err != nil {
+			return err
+		}
+		if err = m.writeUserConfig(u); err != nil {
+			return err
+		}
+	}
+	return m.sync(ctx)
+}
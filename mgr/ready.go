@@ -0,0 +1,75 @@
+package mgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Check is result of a single readiness check.
+type Check struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+
+	// Err is the cause of the failure, it may disclose paths and
+	// database details, so it's not meant for clients.
+	Err error `json:"-"`
+}
+
+// errPwdfileOutOfSync is reported when the pwdfile differs from the database.
+var errPwdfileOutOfSync = errors.New("pwdfile doesn't match the database")
+
+// Ready checks that the manager is able to serve requests: the database
+// is reachable, the pwdfile and root directories are writable and the
+// pwdfile is in sync with the database. All checks are performed even
+// if some of them fail, ok reports whether all of them succeeded.
+// Nothing is changed, so the checks don't wait for mutations and
+// mutations don't wait for them.
+func (m *Mgr) Ready(ctx context.Context) (checks []*Check, ok bool) {
+	ok = true
+	check := func(name string, f func() error) {
+		c := &Check{Name: name, OK: true}
+		if err := f(); err != nil {
+			c.OK, c.Err, ok = false, err, false
+		}
+		checks = append(checks, c)
+	}
+	check("database", func() error {
+		return m.db.PingContext(ctx)
+	})
+	check("pwdfile_writable", func() error {
+		return checkWritable(filepath.Dir(m.pwdfile))
+	})
+	check("root_writable", func() error {
+		return checkWritable(m.root)
+	})
+	check("pwdfile_in_sync", func() error {
+		users, err := m.list(ctx, "")
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(m.pwdfile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, pwdfileContent(users)) {
+			return errPwdfileOutOfSync
+		}
+		return nil
+	})
+	return checks, ok
+}
+
+// checkWritable checks that files can be created in the directory,
+// file modes are not enough since e.g. the filesystem may be read-only.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".vsftpdmgr-ready-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,156 @@
+package mgr
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of corrections made by Reconcile.
+const (
+	// CorrectionPwdfile is a pwdfile entry fixed by rewriting the pwdfile.
+	CorrectionPwdfile = "pwdfile"
+
+	// CorrectionHome is a missing local root recreated.
+	CorrectionHome = "home"
+
+	// CorrectionFS is a directory of a local root brought
+	// in line with the stored fs tree of the user.
+	CorrectionFS = "fs"
+)
+
+// Correction is a single drift fixed by Reconcile.
+type Correction struct {
+	Kind string
+
+	// Target is the affected username, pwdfile line
+	// or directory path prefixed with the username.
+	Target string
+
+	// Reason describes the drift.
+	Reason string
+}
+
+func (c *Correction) String() string {
+	return c.Kind + " " + c.Target + ": " + c.Reason
+}
+
+// Reconcile brings the pwdfile and the root in line with the database:
+// the pwdfile is rewritten when it differs and stored fs trees are re-applied
+// recreating missing local roots, orphan directories are left intact since
+// they may contain data. It returns all the corrections made, nothing
+// means no drift. Users whose local roots cannot be healed are skipped
+// and reported together in the error after the rest are reconciled.
+func (m *Mgr) Reconcile(ctx context.Context) (corrections []*Correction, err error) {
+	m.lock()
+	defer m.mu.Unlock()
+	defer func() {
+		m.stats.observeReconcile(corrections, err)
+	}()
+
+	users, err := m.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	d, err := m.diff(ctx, users)
+	if err != nil {
+		return nil, err
+	}
+
+	correct := func(kind, target, reason string) {
+		corrections = append(corrections, &Correction{Kind: kind, Target: target, Reason: reason})
+	}
+	for _, v := range d.MissingUsers {
+		correct(CorrectionPwdfile, v, "missing in pwdfile")
+	}
+	for _, v := range d.ExtraUsers {
+		correct(CorrectionPwdfile, v, "extra in pwdfile")
+	}
+	for _, v := range d.PasswordMismatches {
+		correct(CorrectionPwdfile, v, "password mismatch")
+	}
+	for _, v := range d.MalformedLines {
+		correct(CorrectionPwdfile, "line "+strconv.Itoa(v), "malformed line")
+	}
+	for _, v := range d.DuplicateLines {
+		correct(CorrectionPwdfile, "line "+strconv.Itoa(v), "duplicate login")
+	}
+	if len(corrections) != 0 {
+		if err = m.sync(ctx); err != nil {
+			return corrections, err
+		}
+	}
+
+	missing := make(map[string]bool, len(d.MissingHomes))
+	for _, username := range d.MissingHomes {
+		missing[username] = true
+	}
+	failed := reconcileError{}
+	for _, u := range users {
+		actions, err := m.reconcileFS(ctx, u.Username)
+		if err != nil {
+			if ctx.Err() != nil {
+				return corrections, err
+			}
+			failed[u.Username] = err
+			continue
+		}
+		if len(actions) == 0 {
+			continue
+		}
+
+		// a recreated local root is a single correction.
+		if missing[u.Username] {
+			correct(CorrectionHome, u.Username, "missing local root")
+			continue
+		}
+		for _, a := range actions {
+			correct(CorrectionFS, path.Join(u.Username, a.Path), a.Action)
+		}
+	}
+	if len(failed) != 0 {
+		return corrections, failed
+	}
+	return corrections, nil
+}
+
+// reconcileFS re-applies the user's fs tree holding the user's lock, the user
+// is read again under it, since it may be changed or gone in the meantime.
+func (m *Mgr) reconcileFS(ctx context.Context, username string) ([]*FSAction, error) {
+	unlock, err := m.lockNames(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	u, err := m.get(ctx, username)
+	if err == ErrUserNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	actions, err := m.planFS(ctx, u, &FSOptions{})
+	if err != nil || len(actions) == 0 {
+		return nil, err
+	}
+	return actions, applyfs(actions)
+}
+
+// reconcileError holds errors of users whose local roots Reconcile failed
+// to heal by their names, such users don't stop the rest from being healed.
+type reconcileError map[string]error
+
+func (e reconcileError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, name+": "+e[name].Error())
+	}
+	return strings.Join(msgs, "; ")
+}
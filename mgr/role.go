@@ -0,0 +1,53 @@
+package mgr
+
+// Role is a named set of permissions granted to API callers.
+type Role string
+
+// Available roles, each next one includes permissions of the previous.
+const (
+	RoleReadOnly Role = "read-only"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Permission is a kind of operation that can be granted to a role.
+type Permission string
+
+// Available permissions.
+const (
+	PermReadUsers   Permission = "users:read"
+	PermPassword    Permission = "users:password"
+	PermWriteUsers  Permission = "users:write"
+	PermDeleteUsers Permission = "users:delete"
+	PermFS          Permission = "users:fs"
+	PermReadAudit   Permission = "audit:read"
+	PermReadMetrics Permission = "metrics:read"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleReadOnly: {PermReadUsers, PermReadMetrics},
+	RoleOperator: {PermReadUsers, PermReadMetrics, PermPassword},
+	RoleAdmin: {PermReadUsers, PermReadMetrics, PermPassword, PermWriteUsers,
+		PermDeleteUsers, PermFS, PermReadAudit},
+}
+
+// ErrInvalidRole is returned when a role is unknown.
+var ErrInvalidRole = &Error{Code: CodeValidation, Message: "role is not valid, must be read-only, operator or admin"}
+
+// ParseRole converts a string into a known role.
+func ParseRole(s string) (Role, error) {
+	if _, ok := rolePermissions[Role(s)]; !ok {
+		return "", ErrInvalidRole
+	}
+	return Role(s), nil
+}
+
+// Can reports whether the role is granted the permission.
+func (r Role) Can(perm Permission) bool {
+	for _, p := range rolePermissions[r] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
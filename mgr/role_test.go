@@ -0,0 +1,25 @@
+package mgr
+
+import "testing"
+
+func TestRoleCan(t *testing.T) {
+	for _, tc := range []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleReadOnly, PermReadUsers, true},
+		{RoleReadOnly, PermPassword, false},
+		{RoleOperator, PermPassword, true},
+		{RoleOperator, PermDeleteUsers, false},
+		{RoleOperator, PermFS, false},
+		{RoleOperator, PermReadAudit, false},
+		{RoleAdmin, PermDeleteUsers, true},
+		{RoleAdmin, PermReadAudit, true},
+		{Role("unknown"), PermReadUsers, false},
+	} {
+		if got := tc.role.Can(tc.perm); got != tc.want {
+			t.Errorf("%s.Can(%s) = %t, want %t", tc.role, tc.perm, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package mgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidSettings is returned when user settings cannot be represented
+// as a vsftpd configuration file, the offending key is reported in details.
+var ErrInvalidSettings = &Error{
+	Code:    CodeValidation,
+	Message: "settings are not valid, keys must match [a-z_]+ and values cannot contain newlines",
+}
+
+var settingKeyRegexp = regexp.MustCompile(`^[a-z_]+$`)
+
+func validSettings(settings map[string]string) error {
+	for k, v := range settings {
+		if !settingKeyRegexp.MatchString(k) || strings.ContainsAny(v, "\r\n") {
+			return ErrInvalidSettings.WithDetails(map[string]interface{}{"key": k})
+		}
+	}
+	return nil
+}
+
+// userConfigPath returns path to the per-user vsftpd configuration file,
+// see user_config_dir option in vsftpd.conf(5).
+func (m *Mgr) userConfigPath(username string) string {
+	return filepath.Join(m.userConfigDir, username)
+}
+
+// writeUserConfig replaces the user's configuration file with its settings,
+// the file is removed when there's nothing to write. Users of tenants get
+// local_root pointing to their local roots, unless it's set explicitly,
+// since vsftpd cannot guess that they're located in tenant directories.
+func (m *Mgr) writeUserConfig(u *User) error {
+	if m.userConfigDir == "" {
+		return nil
+	}
+
+	settings := u.Settings
+	if u.Tenant != "" {
+		if _, ok := settings["local_root"]; !ok {
+			settings = make(map[string]string, len(u.Settings)+1)
+			for k, v := range u.Settings {
+				settings[k] = v
+			}
+			settings["local_root"] = m.home(u)
+		}
+	}
+	if len(settings) == 0 {
+		return m.removeUserConfig(u.Username)
+	}
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.Write(header)
+	for _, k := range keys {
+		sb.WriteString(k + "=" + settings[k] + "\n")
+	}
+
+	path := m.userConfigPath(u.Username)
+	if err := ioutil.WriteFile(path+"__new__", []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+"__new__", path)
+}
+
+func (m *Mgr) removeUserConfig(username string) error {
+	if m.userConfigDir == "" {
+		return nil
+	}
+	if err := os.Remove(m.userConfigPath(username)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package mgr
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// Stats are runtime statistics of a manager, counters
+// and durations are accumulated since it's created.
+type Stats struct {
+	// Syncs is the number of pwdfile syncs, including failed ones.
+	Syncs        uint64
+	SyncFailures uint64
+	SyncDuration time.Duration
+
+	// LockWaits is the number of acquired locks, both the manager's and
+	// cluster-wide ones, LockWaitDuration is the total time spent waiting.
+	LockWaits        uint64
+	LockWaitDuration time.Duration
+
+	// Reconciles is the number of Reconcile runs, including failed ones,
+	// Corrections are numbers of corrections they made by kinds.
+	Reconciles        uint64
+	ReconcileFailures uint64
+	Corrections       map[string]uint64
+
+	// Users and DisabledUsers are visible in the context's tenant.
+	Users         int
+	DisabledUsers int
+
+	DB sql.DBStats
+}
+
+// stats accumulates counters reported by Stats.
+type stats struct {
+	mu               sync.Mutex
+	syncs            uint64
+	syncFailures     uint64
+	syncDuration     time.Duration
+	lockWaits        uint64
+	lockWaitDuration time.Duration
+
+	reconciles        uint64
+	reconcileFailures uint64
+	corrections       map[string]uint64
+}
+
+func (s *stats) observeSync(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	s.syncDuration += d
+	if err != nil {
+		s.syncFailures++
+	}
+}
+
+func (s *stats) observeLockWait(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockWaits++
+	s.lockWaitDuration += d
+}
+
+func (s *stats) observeReconcile(corrections []*Correction, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconciles++
+	if err != nil {
+		s.reconcileFailures++
+	}
+	if s.corrections == nil {
+		s.corrections = map[string]uint64{}
+	}
+	for _, c := range corrections {
+		s.corrections[c.Kind]++
+	}
+}
+
+// lock acquires the manager's lock measuring how long it takes.
+func (m *Mgr) lock() {
+	n := time.Now()
+	m.mu.Lock()
+	m.stats.observeLockWait(time.Since(n))
+}
+
+// Stats returns the manager's runtime statistics.
+func (m *Mgr) Stats(ctx context.Context) (*Stats, error) {
+	m.stats.mu.Lock()
+	s := &Stats{
+		Syncs:            m.stats.syncs,
+		SyncFailures:     m.stats.syncFailures,
+		SyncDuration:     m.stats.syncDuration,
+		LockWaits:        m.stats.lockWaits,
+		LockWaitDuration: m.stats.lockWaitDuration,
+
+		Reconciles:        m.stats.reconciles,
+		ReconcileFailures: m.stats.reconcileFailures,
+		Corrections:       make(map[string]uint64, len(m.stats.corrections)),
+	}
+	for kind, n := range m.stats.corrections {
+		s.Corrections[kind] = n
+	}
+	m.stats.mu.Unlock()
+
+	if err := m.db.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE disabled)
+		FROM users WHERE ($1 = '' OR tenant = $1)`, TenantFromContext(ctx)).Scan(
+		&s.Users, &s.DisabledUsers); err != nil {
+		return nil, err
+	}
+	s.DB = m.db.Stats()
+	return s, nil
+}
@@ -0,0 +1,187 @@
+package mgr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Template is a named fs tree shared by all tenants, users referencing
+// it get the tree merged with their own fs that overrides it.
+type Template struct {
+	Name      string    `json:"name"`
+	FS        FS        `json:"fs"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DefaultTemplate is the name of the template users created
+// without both fs and template are based on, when it exists.
+const DefaultTemplate = "default"
+
+var (
+	// ErrInvalidTemplate is returned when a template cannot be saved.
+	ErrInvalidTemplate = &Error{Code: CodeValidation, Message: "template is not valid"}
+
+	// ErrTemplateNotFound is returned when the requested template doesn't exist.
+	ErrTemplateNotFound = &Error{Code: CodeNotFound, Message: "template not found"}
+
+	// ErrTemplateInUse is returned when deleting a template users are based on.
+	ErrTemplateInUse = &Error{Code: CodeConflict, Message: "template is used by users"}
+)
+
+// SaveTemplate creates a new template or replaces the tree of an existing
+// one, created reports whether the template is new. Local roots of users
+// based on the template are not changed right away, the new tree is applied
+// by the next Save, ApplyFS or Reconcile of the users, the latter re-plans
+// trees of all users.
+func (m *Mgr) SaveTemplate(ctx context.Context, t *Template) (created bool, err error) {
+	// template names follow the same rules as usernames.
+	if !validUsername(t.Name) {
+		return false, ErrInvalidTemplate
+	}
+	if err = checkFS(t.FS); err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(t.FS)
+	if err != nil {
+		return false, err
+	}
+	err = m.db.QueryRowContext(ctx, `INSERT INTO templates (name, fs) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET fs = $2, updated_at = NOW()
+		RETURNING xmax = 0, created_at, updated_at`, t.Name, b).Scan(&created, &t.CreatedAt, &t.UpdatedAt)
+	return created, err
+}
+
+// GetTemplate returns the named template.
+func (m *Mgr) GetTemplate(ctx context.Context, name string) (*Template, error) {
+	t, err := scanTemplate(m.db.QueryRowContext(ctx, `SELECT `+templateColumns+`
+		FROM templates WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, ErrTemplateNotFound
+	}
+	return t, err
+}
+
+// ListTemplates returns list of all templates sorted by name.
+func (m *Mgr) ListTemplates(ctx context.Context) ([]*Template, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT `+templateColumns+` FROM templates ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// DeleteTemplate deletes the named template unless users are based on it.
+func (m *Mgr) DeleteTemplate(ctx context.Context, name string) error {
+	res, err := m.db.ExecContext(ctx, `DELETE FROM templates WHERE name = $1`, name)
+	if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "foreign_key_violation" {
+			return ErrTemplateInUse
+		}
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// isTemplateViolation reports whether err is caused by referencing a missing template.
+func isTemplateViolation(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && e.Code.Name() == "foreign_key_violation" && e.Constraint == "users_template_fkey"
+}
+
+const templateColumns = `name, fs, created_at, updated_at`
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (*Template, error) {
+	var t Template
+	var b []byte
+	if err := row.Scan(&t.Name, &b, &t.CreatedAt, &t.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.FS); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// resolveFS returns the fs tree applied to the user's local root,
+// that is the user's template merged with the user's own fs.
+func (m *Mgr) resolveFS(ctx context.Context, u *User) (FS, error) {
+	fs := FS{}
+	if u.Template != "" {
+		t, err := m.GetTemplate(ctx, u.Template)
+		if err != nil {
+			return FS{}, err
+		}
+		fs = t.FS
+	}
+	if u.FS != nil {
+		fs = mergeFS(fs, *u.FS)
+	}
+	return fs, nil
+}
+
+// mergeFS returns the base tree with attributes set in over replacing its
+// ones, children are matched by name, unmatched ones are appended.
+func mergeFS(base, over FS) FS {
+	if over.Mode != 0 {
+		base.Mode = over.Mode
+	}
+	if over.Owner != "" {
+		base.Owner = over.Owner
+	}
+	if over.Group != "" {
+		base.Group = over.Group
+	}
+	if over.ACL != nil {
+		base.ACL = over.ACL
+	}
+	if over.Type != "" {
+		base.Type = over.Type
+	}
+	if over.Content != "" || over.ContentTemplate != "" {
+		base.Content, base.ContentTemplate = over.Content, over.ContentTemplate
+	}
+
+	if len(over.Children) == 0 {
+		return base
+	}
+
+	// children are copied, so the base tree is never modified.
+	children := make([]FS, len(base.Children), len(base.Children)+len(over.Children))
+	copy(children, base.Children)
+	for _, ch := range over.Children {
+		merged := false
+		for i := range children {
+			if filepath.Clean(children[i].Name) == filepath.Clean(ch.Name) {
+				children[i] = mergeFS(children[i], ch)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			children = append(children, ch)
+		}
+	}
+	base.Children = children
+	return base
+}
@@ -0,0 +1,98 @@
+package mgr
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestMergeFS(t *testing.T) {
+	base := FS{
+		Mode:  0755,
+		Owner: "ftp",
+		Children: []FS{
+			{Name: "read", Mode: 0555},
+			{Name: "write", Mode: 0755},
+		},
+	}
+	got := mergeFS(base, FS{
+		Group: "ftp",
+		Children: []FS{
+			{Name: "./write", Mode: 0700},
+			{Name: "incoming"},
+		},
+	})
+	want := FS{
+		Mode:  0755,
+		Owner: "ftp",
+		Group: "ftp",
+		Children: []FS{
+			{Name: "read", Mode: 0555},
+			{Name: "write", Mode: 0700},
+			{Name: "incoming"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeFS = %+v, want %+v", got, want)
+	}
+	if base.Children[1].Mode != 0755 {
+		t.Error("mergeFS modified the base tree")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	m, root, _ := newTestMgr(t)
+	if _, err := m.SaveTemplate(context.Background(), &Template{
+		Name: DefaultTemplate,
+		FS:   FS{Mode: 0750, Children: []FS{{Name: "read", Mode: 0555}, {Name: "write"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// new users without fs are based on the default template
+	if _, err := m.Save(context.Background(), &User{Username: "test", Password: "insecurePassword"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	u, err := m.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Template != DefaultTemplate {
+		t.Errorf("Template = %q, want %q", u.Template, DefaultTemplate)
+	}
+	testDir(t, root, "test", 0750)
+	testDir(t, root, "test/read", 0555)
+
+	// overrides are merged by name
+	if err = m.Update(context.Background(), "test", &User{
+		FS: &FS{Children: []FS{{Name: "write", Mode: 0700}}},
+	}, FieldFS); err != nil {
+		t.Fatal(err)
+	}
+	testDir(t, root, "test/write", 0700)
+	testDir(t, root, "test/read", 0555)
+
+	if err = m.DeleteTemplate(context.Background(), DefaultTemplate); err != ErrTemplateInUse {
+		t.Errorf("DeleteTemplate error = %v, want %v", err, ErrTemplateInUse)
+	}
+	if _, err = m.Save(context.Background(), &User{
+		Username: "test2",
+		Password: "insecurePassword",
+		Template: "missing",
+	}, 0); err != ErrTemplateNotFound {
+		t.Errorf("Save error = %v, want %v", err, ErrTemplateNotFound)
+	}
+	if err = m.Update(context.Background(), "test", &User{}, FieldTemplate); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.DeleteTemplate(context.Background(), DefaultTemplate); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := m.ListTemplates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 0 {
+		t.Errorf("ListTemplates = %v, want none", templates)
+	}
+}
@@ -0,0 +1,176 @@
+package mgr
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Tenant is an isolated group of users, their local roots are
+// kept in the tenant's own directory inside of the root.
+type Tenant struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type tenantKey struct{}
+
+// WithTenant scopes all manager operations performed with the returned
+// context to users of the named tenant, users of other tenants and the
+// ones without a tenant are invisible to them.
+func WithTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// TenantFromContext returns name of the tenant the context is scoped
+// to, an empty string means the context is not restricted at all.
+func TenantFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+var (
+	// ErrInvalidTenant is returned when a tenant cannot be created
+	// or a user is saved to a tenant it's not scoped to.
+	ErrInvalidTenant = &Error{Code: CodeValidation, Message: "tenant is not valid"}
+
+	// ErrTenantExists is returned when a tenant name is taken either
+	// by another tenant or by a user without a tenant.
+	ErrTenantExists = &Error{Code: CodeConflict, Message: "tenant already exists"}
+
+	// ErrTenantNotEmpty is returned when deleting a tenant having users.
+	ErrTenantNotEmpty = &Error{Code: CodeConflict, Message: "tenant has users"}
+
+	// ErrTenantNotFound is returned when the requested tenant doesn't exist.
+	ErrTenantNotFound = &Error{Code: CodeNotFound, Message: "tenant not found"}
+
+	// ErrTenantsDisabled is returned when tenants are used by a manager
+	// created without a user config dir, vsftpd finds local roots of
+	// tenant users only by local_root written to their configs.
+	ErrTenantsDisabled = &Error{Code: CodeValidation, Message: "tenants require user config dir"}
+)
+
+// CreateTenant creates a new tenant along with its directory.
+func (m *Mgr) CreateTenant(ctx context.Context, name string) (*Tenant, error) {
+	m.lock()
+	defer m.mu.Unlock()
+
+	if m.userConfigDir == "" {
+		return nil, ErrTenantsDisabled
+	}
+
+	// tenant names follow the same rules as usernames
+	// because they share the same directory namespace.
+	if !validUsername(name) {
+		return nil, ErrInvalidTenant
+	}
+	if _, err := os.Lstat(filepath.Join(m.root, name)); err == nil {
+		return nil, ErrTenantExists
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	unlock, err := m.lockNames(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	t := &Tenant{Name: name}
+	err = m.db.QueryRowContext(ctx, `INSERT INTO tenants (name)
+		SELECT $1 WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = $1 AND tenant IS NULL)
+		RETURNING created_at`, name).Scan(&t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTenantExists
+	} else if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			return nil, ErrTenantExists
+		}
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Join(m.root, name), 0755); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DeleteTenant deletes an empty tenant and its directory.
+func (m *Mgr) DeleteTenant(ctx context.Context, name string) error {
+	m.lock()
+	defer m.mu.Unlock()
+
+	unlock, err := m.lockNames(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	res, err := m.db.ExecContext(ctx, `DELETE FROM tenants WHERE name = $1`, name)
+	if err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "foreign_key_violation" {
+			return ErrTenantNotEmpty
+		}
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTenantNotFound
+	}
+	return os.RemoveAll(filepath.Join(m.root, name))
+}
+
+// ListTenants returns list of all tenants sorted by name.
+func (m *Mgr) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT name, created_at FROM tenants ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []*Tenant
+	for rows.Next() {
+		var t Tenant
+		if err = rows.Scan(&t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, &t)
+	}
+	return tenants, rows.Err()
+}
+
+// scopeTenant resolves the tenant a user is saved to, scoped contexts
+// force their tenant, otherwise the tenant must exist if it's set.
+func (m *Mgr) scopeTenant(ctx context.Context, tenant string) (string, error) {
+	scope := TenantFromContext(ctx)
+	if (scope != "" || tenant != "") && m.userConfigDir == "" {
+		return "", ErrTenantsDisabled
+	}
+	if scope != "" {
+		if tenant != "" && tenant != scope {
+			return "", ErrInvalidTenant.WithDetails(map[string]interface{}{
+				"reason": "user cannot be moved to another tenant",
+			})
+		}
+		return scope, nil
+	}
+	if tenant == "" {
+		return "", nil
+	}
+
+	var one int
+	err := m.db.QueryRowContext(ctx, `SELECT 1 FROM tenants WHERE name = $1`, tenant).Scan(&one)
+	if err == sql.ErrNoRows {
+		return "", ErrTenantNotFound
+	}
+	return tenant, err
+}
+
+// home returns path to the user's local root.
+func (m *Mgr) home(u *User) string {
+	return filepath.Join(m.root, u.Tenant, u.Username)
+}
@@ -0,0 +1,134 @@
+package mgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Token is an API access token, only hash of the secret is stored
+// so it cannot be recovered once it's handed over to the client.
+type Token struct {
+	ID         int        `json:"id"`
+	Label      string     `json:"label"`
+	Role       Role       `json:"role"`
+	Tenant     string     `json:"tenant,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+var (
+	// ErrInvalidToken is returned when a token cannot be created.
+	ErrInvalidToken = &Error{Code: CodeValidation, Message: "token is not valid, label must be 1 to 64 characters"}
+
+	// ErrTokenExists is returned when a token label is already taken.
+	ErrTokenExists = &Error{Code: CodeConflict, Message: "token already exists"}
+
+	// ErrTokenNotFound is returned when there's no token with the
+	// given label or secret, the latter means authentication failure.
+	ErrTokenNotFound = &Error{Code: CodeNotFound, Message: "token not found"}
+)
+
+// tokenPrefix makes tokens recognizable, e.g. by secret scanners.
+const tokenPrefix = "vsm_"
+
+// CreateToken creates a new token granted the role returning its secret,
+// that is the only opportunity to get it, since it's not stored anywhere.
+// Non-empty tenant confines the token to users of that tenant.
+func (m *Mgr) CreateToken(ctx context.Context, label string, role Role, tenant string) (string, *Token, error) {
+	if label == "" || len(label) > 64 {
+		return "", nil, ErrInvalidToken
+	}
+	if _, err := ParseRole(string(role)); err != nil {
+		return "", nil, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	t := &Token{Label: label, Role: role, Tenant: tenant}
+	if err := m.db.QueryRowContext(ctx, `INSERT INTO tokens (label, role, tenant, hash)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		RETURNING id, created_at`, label, role, tenant, hashToken(secret)).Scan(&t.ID, &t.CreatedAt); err != nil {
+		if e, ok := err.(*pq.Error); ok {
+			switch e.Code.Name() {
+			case "unique_violation":
+				return "", nil, ErrTokenExists
+			case "foreign_key_violation":
+				return "", nil, ErrTenantNotFound
+			}
+		}
+		return "", nil, err
+	}
+	return secret, t, nil
+}
+
+// RevokeToken deletes the token with the given label.
+func (m *Mgr) RevokeToken(ctx context.Context, label string) error {
+	res, err := m.db.ExecContext(ctx, `DELETE FROM tokens WHERE label = $1`, label)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// ListTokens returns list of all tokens sorted by label.
+func (m *Mgr) ListTokens(ctx context.Context) ([]*Token, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT id, label, role, COALESCE(tenant, ''), created_at, last_used_at
+		FROM tokens ORDER BY label`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*Token
+	for rows.Next() {
+		var t Token
+		if err = rows.Scan(&t.ID, &t.Label, &t.Role, &t.Tenant, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+// Authenticate looks up the token by its secret and
+// marks it as used, returns ErrTokenNotFound if it's unknown.
+func (m *Mgr) Authenticate(ctx context.Context, secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, ErrTokenNotFound
+	}
+
+	var t Token
+	err := m.db.QueryRowContext(ctx, `UPDATE tokens SET last_used_at = NOW() WHERE hash = $1
+		RETURNING id, label, role, COALESCE(tenant, ''), created_at, last_used_at`, hashToken(secret)).Scan(
+		&t.ID, &t.Label, &t.Role, &t.Tenant, &t.CreatedAt, &t.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// hashToken is enough for tokens since unlike passwords
+// they have 256 bits of entropy and cannot be brute-forced.
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
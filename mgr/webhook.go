@@ -0,0 +1,349 @@
+package mgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook event types.
+const (
+	EventUserCreated  = "user.created"
+	EventUserUpdated  = "user.updated"
+	EventUserDisabled = "user.disabled"
+	EventUserDeleted  = "user.deleted"
+)
+
+// actionEvents maps audited actions to webhook events, restored users
+// appear again so receivers see them created, and renaming is an update.
+var actionEvents = map[string]string{
+	ActionCreate:  EventUserCreated,
+	ActionRestore: EventUserCreated,
+	ActionUpdate:  EventUserUpdated,
+	ActionEnable:  EventUserUpdated,
+	ActionRename:  EventUserUpdated,
+	ActionDisable: EventUserDisabled,
+	ActionDelete:  EventUserDeleted,
+}
+
+// Event is the JSON body of webhook requests.
+type Event struct {
+	// ID is the ID of the audit log entry the event originates from,
+	// it can be used to deduplicate events since they can be delivered
+	// more than once.
+	ID       int64                  `json:"id"`
+	Type     string                 `json:"type"`
+	Time     time.Time              `json:"time"`
+	Action   string                 `json:"action"`
+	Username string                 `json:"username"`
+	Tenant   string                 `json:"tenant,omitempty"`
+	Changes  map[string]interface{} `json:"changes,omitempty"`
+}
+
+// Webhook is an HTTP endpoint receiving events about users.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Pending is the number of events waiting for delivery,
+	// Failed is the number of events that exhausted all attempts.
+	Pending int `json:"pending"`
+	Failed  int `json:"failed"`
+}
+
+var (
+	// ErrInvalidWebhook is returned when a webhook cannot be added.
+	ErrInvalidWebhook = &Error{Code: CodeValidation, Message: "webhook is not valid, url must be absolute http or https url"}
+
+	// ErrWebhookExists is returned when a webhook url is already added.
+	ErrWebhookExists = &Error{Code: CodeConflict, Message: "webhook already exists"}
+
+	// ErrWebhookNotFound is returned when there's no webhook with the given url.
+	ErrWebhookNotFound = &Error{Code: CodeNotFound, Message: "webhook not found"}
+)
+
+// AddWebhook adds an endpoint receiving the given events, all events when
+// none are given, the returned secret is used to sign requests to it.
+func (m *Mgr) AddWebhook(ctx context.Context, rawurl string, events []string) (string, *Webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", nil, ErrInvalidWebhook
+	}
+	for _, event := range events {
+		if !validEvent(event) {
+			return "", nil, ErrInvalidWebhook.WithDetails(map[string]interface{}{"event": event})
+		}
+	}
+	if events == nil {
+		events = []string{}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := hex.EncodeToString(b)
+
+	w := &Webhook{URL: rawurl, Events: events}
+	if err = m.db.QueryRowContext(ctx, `INSERT INTO webhooks (url, events, secret) VALUES ($1, $2, $3)
+		RETURNING id, created_at`, rawurl, pq.Array(events), secret).Scan(&w.ID, &w.CreatedAt); err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			return "", nil, ErrWebhookExists
+		}
+		return "", nil, err
+	}
+	return secret, w, nil
+}
+
+func validEvent(event string) bool {
+	for _, v := range actionEvents {
+		if v == event {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveWebhook removes the webhook with the given url
+// along with all its undelivered events.
+func (m *Mgr) RemoveWebhook(ctx context.Context, rawurl string) error {
+	res, err := m.db.ExecContext(ctx, `DELETE FROM webhooks WHERE url = $1`, rawurl)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListWebhooks returns list of all webhooks sorted by url.
+func (m *Mgr) ListWebhooks(ctx context.Context) ([]*Webhook, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT w.id, w.url, w.events, w.created_at,
+		COUNT(o.id) FILTER (WHERE o.next_attempt_at IS NOT NULL),
+		COUNT(o.id) FILTER (WHERE o.next_attempt_at IS NULL)
+		FROM webhooks w LEFT JOIN outbox o ON o.webhook_id = w.id
+		GROUP BY w.id ORDER BY w.url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []*Webhook
+	for rows.Next() {
+		var w Webhook
+		if err = rows.Scan(&w.ID, &w.URL, pq.Array(&w.Events), &w.CreatedAt,
+			&w.Pending, &w.Failed); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &w)
+	}
+	return webhooks, rows.Err()
+}
+
+// enqueueEvents puts the event originating from the audit entry to the
+// outbox of every webhook subscribed to it, it has to be done in the
+// transaction of the mutation, so events are never lost or made up.
+func enqueueEvents(ctx context.Context, tx *sql.Tx, e *AuditEntry) error {
+	event := &Event{
+		ID:       e.ID,
+		Type:     actionEvents[e.Action],
+		Time:     e.Time,
+		Action:   e.Action,
+		Username: e.Username,
+		Tenant:   e.Tenant,
+		Changes:  e.Changes,
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO outbox (webhook_id, event, payload)
+		SELECT id, $1, $2 FROM webhooks WHERE events = '{}' OR $1 = ANY (events)`, event.Type, b)
+	return err
+}
+
+const (
+	// webhookPollInterval is how often the outbox is checked for due events.
+	webhookPollInterval = time.Second
+
+	// webhookTimeout limits a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+
+	// webhookMaxAttempts is the number of delivery attempts after which
+	// an event is considered failed, with the backoff below it's retried
+	// for about a day.
+	webhookMaxAttempts = 30
+
+	// webhookBatchSize is the number of events claimed at once.
+	webhookBatchSize = 10
+
+	// webhookMinBackoff doubles after every failed attempt up to webhookMaxBackoff.
+	webhookMinBackoff = 5 * time.Second
+	webhookMaxBackoff = time.Hour
+)
+
+// DeliverWebhooks sends queued events to webhooks until ctx is done,
+// it's safe to run it in multiple processes sharing the database.
+// Events are delivered at least once, in order for every webhook
+// unless a delivery fails, receivers are expected to respond with
+// a 2xx status code, anything else is retried with exponential backoff.
+func (m *Mgr) DeliverWebhooks(ctx context.Context) error {
+	client := &http.Client{Timeout: webhookTimeout}
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := m.deliverWebhooks(ctx, client)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fmt.Fprintf(os.Stderr, "mgr error: %v\n", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverWebhooks sends a batch of due events returning how many of them were
+// processed. Events are claimed in a short transaction by postponing their
+// next attempt, so concurrent dispatchers never send the same event and no
+// transaction is kept open while receivers respond, events claimed by a
+// dispatcher that dies halfway are retried when the claim expires.
+func (m *Mgr) deliverWebhooks(ctx context.Context, client *http.Client) (int, error) {
+	type delivery struct {
+		id       int64
+		url      string
+		secret   string
+		event    string
+		payload  []byte
+		attempts int
+	}
+
+	rows, err := m.db.QueryContext(ctx, `UPDATE outbox o SET attempts = o.attempts + 1,
+			next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = o.webhook_id AND o.id IN (
+			SELECT id FROM outbox WHERE next_attempt_at <= NOW()
+			ORDER BY id LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING o.id, w.url, w.secret, o.event, o.payload, o.attempts`,
+		webhookBatchSize, (webhookBatchSize * webhookTimeout).Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var deliveries []*delivery
+	for rows.Next() {
+		var d delivery
+		if err = rows.Scan(&d.id, &d.url, &d.secret, &d.event, &d.payload, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].id < deliveries[j].id
+	})
+
+	for _, d := range deliveries {
+		if derr := postEvent(ctx, client, d.url, d.secret, d.event, d.id, d.payload); derr == nil {
+			_, err = m.db.ExecContext(ctx, `DELETE FROM outbox WHERE id = $1`, d.id)
+		} else {
+			// NULL next_attempt_at marks events that failed for good.
+			var next interface{}
+			if d.attempts < webhookMaxAttempts {
+				next = time.Now().Add(webhookBackoff(d.attempts - 1))
+			}
+			_, err = m.db.ExecContext(ctx, `UPDATE outbox SET next_attempt_at = $2, last_error = $3
+				WHERE id = $1`, d.id, next, derr.Error())
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(deliveries), nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookMinBackoff
+	for i := 0; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// signatureHeader carries HMAC-SHA256 of the timestamp header value and
+// the request body joined with a dot computed with the webhook secret, so
+// receivers can verify the sender and reject replays of old requests.
+const (
+	signatureHeader = "X-Vsftpdmgr-Signature"
+	timestampHeader = "X-Vsftpdmgr-Timestamp"
+)
+
+// signPayload returns value of the signature header for the payload
+// sent at the timestamp, that is the value of the timestamp header.
+func signPayload(secret, timestamp string, payload []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(payload)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func postEvent(ctx context.Context, client *http.Client, endpoint, secret, event string, id int64, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vsftpdmgr")
+	req.Header.Set("X-Vsftpdmgr-Event", event)
+	req.Header.Set("X-Vsftpdmgr-Delivery", strconv.FormatInt(id, 10))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, signPayload(secret, timestamp, payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", endpoint, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package mgr
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignPayload(t *testing.T) {
+	// echo -n '1603000000.{"id":1}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=ddc357afe51fe22b0577d14891b890a509a01a188e5af4fcda47868bb8fff9e5"
+	if got := signPayload("secret", "1603000000", []byte(`{"id":1}`)); got != want {
+		t.Errorf("signPayload = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 10 * time.Second},
+		{4, 80 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	} {
+		if got := webhookBackoff(tc.attempts); got != tc.want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	m, _, _ := newTestMgr(t)
+	events := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		events <- r
+		bodies <- b
+	}))
+	defer srv.Close()
+
+	secret, _, err := m.AddWebhook(context.Background(), srv.URL, []string{EventUserDeleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &User{Username: "test", Password: "insecurePassword"}
+	if _, err = m.Save(context.Background(), u, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Delete(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := m.deliverWebhooks(context.Background(), srv.Client()); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("deliverWebhooks = %d, want only the subscribed event", n)
+	}
+	r, b := <-events, <-bodies
+	want := signPayload(secret, r.Header.Get(timestampHeader), b)
+	if got := r.Header.Get(signatureHeader); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	var event Event
+	if err = json.Unmarshal(b, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventUserDeleted || event.Username != u.Username {
+		t.Errorf("event = %+v, want %s of %s", event, EventUserDeleted, u.Username)
+	}
+
+	webhooks, err := m.ListWebhooks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || webhooks[0].Pending != 0 {
+		t.Errorf("ListWebhooks = %+v, want one webhook with nothing pending", webhooks)
+	}
+}